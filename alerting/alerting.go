@@ -0,0 +1,340 @@
+/*
+Package alerting evaluates threshold alert rules over the metrics of a
+gatherer and notifies webhooks and Alertmanagers of firing and resolved
+alerts:
+
+	alerts:
+	  - alert: GPUTemperatureHigh
+	    metric: gpu_temperature
+	    matchers:
+	      - name=~"Tesla.*"
+	    op: ">"
+	    threshold: 85
+	    for: 5m
+	    severity: critical
+	    annotations:
+	      summary: gpu is too hot
+
+An alert is pending while the comparison holds for a series and fires once
+it held for the "for" duration, it is resolved when the comparison no longer
+holds or the series disappears.
+*/
+package alerting
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksang/hana/rules"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+// Alert states
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Rule is a threshold alert rule
+type Rule struct {
+	Alert       string            `yaml:"alert"`
+	Metric      string            `yaml:"metric"`
+	Matchers    []string          `yaml:"matchers"`
+	Op          string            `yaml:"op"`
+	Threshold   float64           `yaml:"threshold"`
+	For         string            `yaml:"for"`
+	Severity    string            `yaml:"severity"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+
+	matchers []*rules.Matcher
+	duration time.Duration
+}
+
+type ruleFile struct {
+	Alerts []*Rule `yaml:"alerts"`
+}
+
+// Parse parses the rules of an alert file
+func Parse(content []byte) ([]*Rule, error) {
+	var f ruleFile
+	if err := yaml.Unmarshal(content, &f); err != nil {
+		return nil, err
+	}
+	for i, r := range f.Alerts {
+		if len(r.Alert) == 0 {
+			return nil, fmt.Errorf("alert %d: name is missing", i+1)
+		}
+		if len(r.Metric) == 0 {
+			return nil, fmt.Errorf("alert %s: metric is missing", r.Alert)
+		}
+		if _, ok := comparisons[r.Op]; !ok {
+			return nil, fmt.Errorf("alert %s: unknown op %q", r.Alert, r.Op)
+		}
+		for _, s := range r.Matchers {
+			m, err := rules.ParseMatcher(s)
+			if err != nil {
+				return nil, fmt.Errorf("alert %s: matcher %s: %v", r.Alert, s, err)
+			}
+			r.matchers = append(r.matchers, m)
+		}
+		if len(r.For) > 0 {
+			d, err := time.ParseDuration(r.For)
+			if err != nil {
+				return nil, fmt.Errorf("alert %s: invalid for, %v", r.Alert, err)
+			}
+			r.duration = d
+		}
+	}
+	return f.Alerts, nil
+}
+
+// Load reads and parses alert files
+func Load(paths ...string) ([]*Rule, error) {
+	var rs []*Rule
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rs = append(rs, r...)
+	}
+	return rs, nil
+}
+
+var comparisons = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// Alert is an alert of a rule for a series
+type Alert struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	Value       float64
+	State       string
+	ActiveAt    time.Time
+	FiredAt     time.Time
+	ResolvedAt  time.Time
+}
+
+// labels of an alert are the series labels, the rule labels, alertname and
+// severity
+func (r *Rule) labels(series map[string]string) map[string]string {
+	labels := make(map[string]string, len(series)+len(r.Labels)+2)
+	for name, value := range series {
+		labels[name] = value
+	}
+	for name, value := range r.Labels {
+		labels[name] = value
+	}
+	labels["alertname"] = r.Alert
+	if len(r.Severity) > 0 {
+		labels["severity"] = r.Severity
+	}
+	return labels
+}
+
+// Manager evaluates alert rules and notifies receivers
+type Manager struct {
+	rules     []*Rule
+	gatherer  prometheus.Gatherer
+	notifiers []Notifier
+	now       func() time.Time
+
+	mu     sync.Mutex
+	active map[string]*Alert
+
+	alertsMetric  *prometheus.GaugeVec
+	failureMetric *prometheus.CounterVec
+	quitCh        chan struct{}
+	doneCh        chan struct{}
+}
+
+// NewManager creates a manager evaluating rules over g
+func NewManager(rs []*Rule, g prometheus.Gatherer, notifiers ...Notifier) *Manager {
+	return &Manager{
+		rules:     rs,
+		gatherer:  g,
+		notifiers: notifiers,
+		now:       time.Now,
+		active:    map[string]*Alert{},
+		alertsMetric: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "hana_alerts",
+				Help: "active alerts by state",
+			},
+			[]string{"alertname", "state"},
+		),
+		failureMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_alert_notifications_failed_total",
+				Help: "failed alert notifications by receiver",
+			},
+			[]string{"receiver"},
+		),
+	}
+}
+
+// Eval evaluates the rules once and notifies the receivers
+func (m *Manager) Eval() error {
+	mfs, err := m.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	data := rules.Samples(mfs)
+	now := m.now()
+
+	m.mu.Lock()
+	seen := map[string]bool{}
+	var changed, current []*Alert
+	for _, r := range m.rules {
+		cmp := comparisons[r.Op]
+	next:
+		for _, s := range data[r.Metric] {
+			for _, matcher := range r.matchers {
+				if !matcher.Matches(s.Labels) {
+					continue next
+				}
+			}
+			if !cmp(s.Value, r.Threshold) {
+				continue
+			}
+			labels := r.labels(s.Labels)
+			key := signature(labels)
+			seen[key] = true
+			a, ok := m.active[key]
+			if !ok {
+				a = &Alert{Labels: labels, Annotations: r.Annotations, State: StatePending, ActiveAt: now}
+				m.active[key] = a
+			}
+			a.Value = s.Value
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= r.duration {
+				a.State = StateFiring
+				a.FiredAt = now
+				changed = append(changed, a)
+			}
+			if a.State == StateFiring {
+				current = append(current, a)
+			}
+		}
+	}
+	for key, a := range m.active {
+		if seen[key] {
+			continue
+		}
+		delete(m.active, key)
+		if a.State == StateFiring {
+			a.State = StateResolved
+			a.ResolvedAt = now
+			changed = append(changed, a)
+			current = append(current, a)
+		}
+	}
+	m.alertsMetric.Reset()
+	for _, a := range m.active {
+		m.alertsMetric.WithLabelValues(a.Labels["alertname"], a.State).Inc()
+	}
+	m.mu.Unlock()
+
+	for _, n := range m.notifiers {
+		alerts := changed
+		if n.Resend() {
+			alerts = current
+		}
+		if len(alerts) == 0 {
+			continue
+		}
+		if err := n.Notify(alerts); err != nil {
+			m.failureMetric.WithLabelValues(n.Name()).Inc()
+			log.Println("failed to send alerts,", err)
+		}
+	}
+	return nil
+}
+
+// Alerts returns the pending and firing alerts
+func (m *Manager) Alerts() []*Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := make([]*Alert, 0, len(m.active))
+	for _, a := range m.active {
+		alerts = append(alerts, a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return signature(alerts[i].Labels) < signature(alerts[j].Labels)
+	})
+	return alerts
+}
+
+// Start evaluates the rules every interval until Stop is called
+func (m *Manager) Start(interval time.Duration) {
+	m.quitCh = make(chan struct{})
+	m.doneCh = make(chan struct{})
+	go func() {
+		defer close(m.doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.quitCh:
+				return
+			case <-ticker.C:
+				if err := m.Eval(); err != nil {
+					log.Println("failed to evaluate alerts,", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the evaluation started by Start
+func (m *Manager) Stop() {
+	if m.quitCh == nil {
+		return
+	}
+	close(m.quitCh)
+	<-m.doneCh
+	m.quitCh = nil
+}
+
+func (m *Manager) Describe(ch chan<- *prometheus.Desc) {
+	m.alertsMetric.Describe(ch)
+	m.failureMetric.Describe(ch)
+}
+
+func (m *Manager) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.alertsMetric.Collect(ch)
+	m.failureMetric.Collect(ch)
+}
+
+// signature identifies the label set of an alert
+func signature(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "\xfe" + labels[name]
+	}
+	return strings.Join(pairs, "\xff")
+}
@@ -0,0 +1,160 @@
+package alerting
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const testAlerts = `
+alerts:
+  - alert: GPUTemperatureHigh
+    metric: gpu_temperature
+    matchers:
+      - name=~"Tesla.*"
+    op: ">"
+    threshold: 85
+    for: 1m
+    severity: critical
+    annotations:
+      summary: gpu is too hot
+  - alert: GPUIdle
+    metric: gpu_utilization
+    op: "=="
+    threshold: 0
+    for: 1h
+    severity: warning
+`
+
+// receiver records the requests of a local HTTP stand-in
+type receiver struct {
+	mu     sync.Mutex
+	bodies map[string][]json.RawMessage
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], body)
+	r.mu.Unlock()
+}
+
+func (r *receiver) requests(path string) []json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bodies[path]
+}
+
+func TestManager(t *testing.T) {
+	rs, err := Parse([]byte(testAlerts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := &receiver{bodies: map[string][]json.RawMessage{}}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	temp := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gpu_temperature", Help: "t"}, []string{"id", "name"})
+	util := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gpu_utilization", Help: "u"}, []string{"id", "name"})
+	reg.MustRegister(temp, util)
+	temp.WithLabelValues("1", "Tesla P100").Set(90)
+	temp.WithLabelValues("2", "Tesla P100").Set(60)
+	temp.WithLabelValues("3", "GeForce").Set(95)
+	util.WithLabelValues("1", "Tesla P100").Set(0)
+
+	m := NewManager(rs, reg, &Webhook{URL: server.URL + "/hook"}, &Alertmanager{URL: server.URL, EndsAfter: time.Minute})
+	reg.MustRegister(m)
+	now := time.Unix(1500000000, 0)
+	m.now = func() time.Time { return now }
+
+	cases := []struct {
+		advance    time.Duration
+		update     func()
+		states     []string
+		webhooks   int
+		alertmgr   int
+		lastStatus string
+	}{
+		// pending for temperature and idle
+		{0, nil, []string{StatePending, StatePending}, 0, 0, ""},
+		// temperature fires after 1m
+		{time.Minute, nil, []string{StatePending, StateFiring}, 1, 1, StateFiring},
+		// firing alerts are resent to the Alertmanager only
+		{time.Minute, nil, []string{StatePending, StateFiring}, 1, 2, StateFiring},
+		// temperature resolves
+		{time.Minute, func() { temp.WithLabelValues("1", "Tesla P100").Set(70) }, []string{StatePending}, 2, 3, StateResolved},
+	}
+	for idx, c := range cases {
+		now = now.Add(c.advance)
+		if c.update != nil {
+			c.update()
+		}
+		if err := m.Eval(); err != nil {
+			t.Fatal(err)
+		}
+		alerts := m.Alerts()
+		var states []string
+		for _, a := range alerts {
+			states = append(states, a.State)
+		}
+		if len(states) != len(c.states) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, states, c.states)
+			continue
+		}
+		for i := range states {
+			if states[i] != c.states[i] {
+				t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, states, c.states)
+			}
+		}
+		hooks, ams := recv.requests("/hook"), recv.requests("/api/v2/alerts")
+		if len(hooks) != c.webhooks || len(ams) != c.alertmgr {
+			t.Errorf("Case #%d, actual: %d webhooks %d alertmanager posts, expected: %d %d",
+				idx+1, len(hooks), len(ams), c.webhooks, c.alertmgr)
+			continue
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+		var payload webhookPayload
+		if err := json.Unmarshal(hooks[len(hooks)-1], &payload); err != nil {
+			t.Fatal(err)
+		}
+		if len(payload.Alerts) != 1 || payload.Alerts[0].Status != c.lastStatus ||
+			payload.Alerts[0].Labels["alertname"] != "GPUTemperatureHigh" ||
+			payload.Alerts[0].Labels["id"] != "1" || payload.Alerts[0].Labels["severity"] != "critical" {
+			t.Errorf("Case #%d, actual webhook: %+v", idx+1, payload)
+		}
+		var posted []alertmanagerAlert
+		if err := json.Unmarshal(ams[len(ams)-1], &posted); err != nil {
+			t.Fatal(err)
+		}
+		if len(posted) != 1 || posted[0].EndsAt == nil || posted[0].Annotations["summary"] != "gpu is too hot" {
+			t.Errorf("Case #%d, actual alertmanager alerts: %+v", idx+1, posted)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		"alerts:\n  - metric: x\n    op: \">\"\n",
+		"alerts:\n  - alert: a\n    op: \">\"\n",
+		"alerts:\n  - alert: a\n    metric: x\n    op: \"=>\"\n",
+		"alerts:\n  - alert: a\n    metric: x\n    op: \">\"\n    for: soon\n",
+		"alerts:\n  - alert: a\n    metric: x\n    op: \">\"\n    matchers: [\"id\"]\n",
+	}
+	for idx, c := range cases {
+		if _, err := Parse([]byte(c)); err == nil {
+			t.Errorf("Case #%d, actual: nil, expected: error", idx+1)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifier sends alerts to a receiver
+type Notifier interface {
+	// Name identifies the receiver
+	Name() string
+	// Resend reports whether firing alerts are sent on every evaluation,
+	// otherwise only alerts which started firing or resolved are sent
+	Resend() bool
+	Notify(alerts []*Alert) error
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return nil
+}
+
+// webhookAlert is an alert in the payload of webhooks
+type webhookAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Value       float64           `json:"value"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"`
+}
+
+// webhookPayload is posted to webhooks
+type webhookPayload struct {
+	Receiver string         `json:"receiver"`
+	Alerts   []webhookAlert `json:"alerts"`
+}
+
+// Webhook posts alerts which started firing or resolved as JSON:
+//
+//	{"receiver": "hana", "alerts": [{"status": "firing", "labels": {...},
+//	  "annotations": {...}, "value": 90, "startsAt": "...", "endsAt": "..."}]}
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) Name() string {
+	return w.URL
+}
+
+func (w *Webhook) Resend() bool {
+	return false
+}
+
+func (w *Webhook) Notify(alerts []*Alert) error {
+	payload := webhookPayload{Receiver: "hana"}
+	for _, a := range alerts {
+		alert := webhookAlert{
+			Status:      a.State,
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			Value:       a.Value,
+			StartsAt:    a.FiredAt,
+		}
+		if a.State == StateResolved {
+			endsAt := a.ResolvedAt
+			alert.EndsAt = &endsAt
+		}
+		payload.Alerts = append(payload.Alerts, alert)
+	}
+	return postJSON(w.URL, payload)
+}
+
+// alertmanagerAlert is an alert of the Alertmanager v2 API
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       *time.Time        `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Alertmanager posts firing alerts on every evaluation and resolved ones
+// to /api/v2/alerts of an Alertmanager, firing alerts end after endsAfter
+// unless they are sent again
+type Alertmanager struct {
+	URL       string
+	EndsAfter time.Duration
+}
+
+func (am *Alertmanager) Name() string {
+	return am.URL
+}
+
+func (am *Alertmanager) Resend() bool {
+	return true
+}
+
+func (am *Alertmanager) Notify(alerts []*Alert) error {
+	payload := make([]alertmanagerAlert, 0, len(alerts))
+	for _, a := range alerts {
+		alert := alertmanagerAlert{
+			Labels:      a.Labels,
+			Annotations: a.Annotations,
+			StartsAt:    a.FiredAt,
+		}
+		switch {
+		case a.State == StateResolved:
+			endsAt := a.ResolvedAt
+			alert.EndsAt = &endsAt
+		case am.EndsAfter > 0:
+			endsAt := time.Now().Add(am.EndsAfter)
+			alert.EndsAt = &endsAt
+		}
+		payload = append(payload, alert)
+	}
+	return postJSON(strings.TrimSuffix(am.URL, "/")+"/api/v2/alerts", payload)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ksang/hana/pusher"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v2"
+)
+
+// commands are run by "hana <command>", without command hana runs the
+// pipelines
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"check": runCheck,
+	"parse": runParse,
+}
+
+// runCheck validates the config and creates every pipeline without starting
+// it, the exit code is 1 if any pipeline is invalid. Files aren't opened and
+// nothing is pushed, the pipelines are stopped right away.
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	confFiles := fs.String("d", "hana.conf", "configuration file location, use comma if you have multiple config files")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := loadConfig(strings.Split(*confFiles, ","))
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid config,", err)
+		return 1
+	}
+	code := 0
+	for _, pc := range cfg.Pipelines {
+		p, err := newPipeline(pc)
+		if err != nil {
+			fmt.Fprintf(stderr, "pipeline %s: %v\n", pc.Name, err)
+			code = 1
+			continue
+		}
+		p.stop()
+		fmt.Fprintf(stdout, "pipeline %s: ok\n", pc.Name)
+	}
+	return code
+}
+
+// runParse runs the parser of a pipeline over an input file and prints the
+// resulting metrics in the Prometheus text format, errors of lines are
+// printed with their line number and set the exit code to 1
+func runParse(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("parse", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	confFiles := fs.String("d", "hana.conf", "configuration file location, use comma if you have multiple config files")
+	input := fs.String("input", "", "input file parsed by the pipeline, - for stdin")
+	name := fs.String("pipeline", "", "name of the pipeline, required if the config has more than one")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if len(*input) == 0 {
+		fmt.Fprintln(stderr, "input is missing")
+		return 2
+	}
+	cfg, err := loadConfig(strings.Split(*confFiles, ","))
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid config,", err)
+		return 1
+	}
+	pc, err := selectPipeline(cfg, *name)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	// metrics are set without pushurl and rejected lines are only printed
+	conf, err := overrideConf(pc.Conf, map[string]interface{}{"logparsed": false, "deadletter": ""})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	p, err := pusher.New(pc.Parser, conf)
+	if err != nil {
+		fmt.Fprintf(stderr, "pipeline %s: %v\n", pc.Name, err)
+		return 1
+	}
+	lp, ok := p.(pusher.LineParser)
+	if !ok {
+		fmt.Fprintf(stderr, "parser %s can't parse offline\n", pc.Parser)
+		return 1
+	}
+	// errors of lines are printed below instead of logged
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	in := os.Stdin
+	if *input != "-" {
+		if in, err = os.Open(*input); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer in.Close()
+	}
+	code := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if err := lp.ParseLine(strings.TrimSuffix(scanner.Text(), "\r")); err != nil {
+			fmt.Fprintf(stderr, "%s:%d: %v\n", *input, n, err)
+			code = 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	mfs, err := p.Gatherer().Gather()
+	if err != nil {
+		fmt.Fprintln(stderr, "error gathering metrics,", err)
+		code = 1
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(stdout, mf); err != nil {
+			fmt.Fprintln(stderr, "error encoding metrics,", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// selectPipeline returns the pipeline named name, or the only pipeline if
+// name is empty
+func selectPipeline(cfg *Config, name string) (*PipelineConfig, error) {
+	if len(name) == 0 {
+		if len(cfg.Pipelines) != 1 {
+			return nil, fmt.Errorf("config has %d pipelines, select one by -pipeline", len(cfg.Pipelines))
+		}
+		return cfg.Pipelines[0], nil
+	}
+	for _, pc := range cfg.Pipelines {
+		if pc.Name == name {
+			return pc, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown pipeline %s", name)
+}
+
+// overrideConf sets keys of a pipeline config
+func overrideConf(conf string, keys map[string]interface{}) (string, error) {
+	m := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(conf), &m); err != nil {
+		return "", err
+	}
+	for k, v := range keys {
+		m[k] = v
+	}
+	content, err := yaml.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "hana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestRunCheck(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"ok.conf":      "pipelines:\n  - {name: a, parser: asaka, filepath: a.log}\n  - {name: b, parser: gpumeta, filepath: b.csv}\n",
+		"parser.conf":  "pipelines:\n  - {name: a, parser: asaka, filepath: a.log}\n  - {name: b, parser: csv, filepath: b.csv}\n",
+		"invalid.conf": "pipelines:\n  - {name: a, parser: unknown}\n",
+		"names.conf":   "pipelines:\n  - {name: a, parser: json, filepath: a.log, metrics: [{field: v, name: bad-name}]}\n",
+	})
+	defer os.RemoveAll(dir)
+	// dead-letter files of sinks.conf, one in a missing directory
+	rejected := []string{filepath.Join(dir, "a.rejected"), filepath.Join(dir, "missing", "b.rejected")}
+	sinks := fmt.Sprintf("pipelines:\n  - {name: a, parser: asaka, filepath: a.log, deadletter: %s}\n"+
+		"  - {name: b, parser: asaka, filepath: b.log, deadletter: %s}\n", rejected[0], rejected[1])
+	if err := ioutil.WriteFile(filepath.Join(dir, "sinks.conf"), []byte(sinks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		conf   string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"ok.conf", 0, "pipeline a: ok\npipeline b: ok\n", ""},
+		{"parser.conf", 1, "pipeline a: ok\n", "pipeline b: "},
+		{"invalid.conf", 1, "", "invalid config, pipeline a: unknown parser"},
+		{"missing.conf", 1, "", "invalid config, open "},
+		{"names.conf", 1, "", `pipeline a: invalid metric name "bad-name"`},
+		{"sinks.conf", 0, "pipeline a: ok\npipeline b: ok\n", ""},
+	}
+
+	for idx, c := range cases {
+		var stdout, stderr bytes.Buffer
+		code := runCheck([]string{"-d", filepath.Join(dir, c.conf)}, &stdout, &stderr)
+		if code != c.code || stdout.String() != c.stdout || !strings.HasPrefix(stderr.String(), c.stderr) {
+			t.Errorf("Case #%d, actual: %v %q %q, expected: %v %q %q",
+				idx+1, code, stdout.String(), stderr.String(), c.code, c.stdout, c.stderr)
+		}
+	}
+	for _, path := range rejected {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("actual: %v, expected: %s not created", err, path)
+		}
+	}
+}
+
+func TestRunParse(t *testing.T) {
+	now := time.Now().Unix()
+	dir := writeTestFiles(t, map[string]string{
+		"asaka.conf": "datasource: asaka\nfilepath: a.log\n",
+		"two.conf":   "pipelines:\n  - {name: a, parser: asaka, filepath: a.log}\n  - {name: b, parser: asaka, filepath: b.log}\n",
+		"ok.log":     fmt.Sprintf("%d,1,0,1,TEST,983,4,2097154\n", now),
+		"bad.log":    fmt.Sprintf("%d,1,0,1,TEST,983,4,2097154\n1,1\n%d,1,0,1,TEST,983,x,0\n", now, now),
+	})
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"-d", "asaka.conf", "--input", "ok.log"}, 0,
+			`asaka_api_call_count{api="TEST",client_id="1",pipeline="a.log",session="0"} 4`, ""},
+		{[]string{"-d", "asaka.conf", "--input", "bad.log"}, 1,
+			`asaka_api_call_count{api="TEST",client_id="1",pipeline="a.log",session="0"} 4`,
+			"bad.log:2: missing_fields: 2 fields, expected 8\nbad.log:3: invalid_number: "},
+		{[]string{"-d", "two.conf", "--input", "ok.log", "-pipeline", "b"}, 0,
+			`asaka_api_call_count{api="TEST",client_id="1",pipeline="b",session="0"} 4`, ""},
+		{[]string{"-d", "two.conf", "--input", "ok.log"}, 2, "", "config has 2 pipelines"},
+		{[]string{"-d", "two.conf", "--input", "ok.log", "-pipeline", "c"}, 2, "", "unknown pipeline c"},
+		{[]string{"-d", "asaka.conf"}, 2, "", "input is missing"},
+		{[]string{"-d", "asaka.conf", "--input", "missing.log"}, 1, "", "open "},
+	}
+
+	for idx, c := range cases {
+		args := make([]string, len(c.args))
+		for i, arg := range c.args {
+			args[i] = arg
+			if i > 0 && (c.args[i-1] == "-d" || c.args[i-1] == "--input") {
+				args[i] = filepath.Join(dir, arg)
+			}
+		}
+		var stdout, stderr bytes.Buffer
+		code := runParse(args, &stdout, &stderr)
+		errOut := strings.Replace(stderr.String(), dir+string(filepath.Separator), "", -1)
+		if code != c.code || !strings.Contains(stdout.String(), c.stdout) || !strings.HasPrefix(errOut, c.stderr) {
+			t.Errorf("Case #%d, actual: %v %q %q, expected: %v %q %q",
+				idx+1, code, stdout.String(), errOut, c.code, c.stdout, c.stderr)
+		}
+	}
+}
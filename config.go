@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ksang/hana/datasource"
+	"github.com/ksang/hana/pusher"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the config of a hana process, a server section and the list of
+// pipelines:
+//
+//	server:
+//	  listenaddress: :9091
+//	  tls:
+//	    certfile: hana.crt
+//	    keyfile: hana.key
+//	  metricspath: /metrics
+//	  cardinalitypath: /debug/cardinality
+//	  reloadpath: /-/reload
+//	  draintimeout: 10s
+//	  shutdowntimeout: 5s
+//	pipelines:
+//	  - name: gpu0
+//	    consumer: file
+//	    parser: gpumeta
+//	    filepath: gpu_metadata.csv
+//	    constlabels:
+//	      node: gpu-node-1
+//	    pushurl: http://pushgateway:9091
+//
+// Keys of a pipeline are passed to its consumer and parser, keys which neither
+// of them reads are rejected. A config without server and pipelines is the
+// legacy config of a single pipeline, whose listenaddress is read as server
+// listen address.
+type Config struct {
+	Server    ServerConfig      `yaml:"server"`
+	Pipelines []*PipelineConfig `yaml:"-"`
+}
+
+// ServerConfig is the config of the http server exposing metrics
+type ServerConfig struct {
+	ListenAddress   string    `yaml:"listenaddress"`
+	TLS             TLSConfig `yaml:"tls"`
+	MetricsPath     string    `yaml:"metricspath"`
+	CardinalityPath string    `yaml:"cardinalitypath"`
+	// ReloadPath serves config reloads without authentication, it is
+	// disabled unless set
+	ReloadPath string `yaml:"reloadpath"`
+	// DrainTimeout bounds draining the pipelines and their final pushes on
+	// shutdown, ShutdownTimeout bounds closing the http server after them
+	DrainTimeout    time.Duration `yaml:"draintimeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdowntimeout"`
+}
+
+// TLSConfig enables https when both files are set
+type TLSConfig struct {
+	CertFile string `yaml:"certfile"`
+	KeyFile  string `yaml:"keyfile"`
+}
+
+// Enabled reports whether the server is served by https
+func (t TLSConfig) Enabled() bool {
+	return len(t.CertFile) > 0
+}
+
+// PipelineConfig is the config of a pipeline, its name defaults to the
+// legacy "pipeline" key and then to "filepath", its parser to the legacy
+// "datasource" key
+type PipelineConfig struct {
+	Name        string            `yaml:"pipeline"`
+	Consumer    string            `yaml:"consumer"`
+	Parser      string            `yaml:"parser"`
+	ConstLabels map[string]string `yaml:"constlabels"`
+	PushURL     string            `yaml:"pushurl"`
+	// Conf is the YAML config of the consumer and parser
+	Conf string `yaml:"-"`
+	// keys are the keys of the pipeline entry
+	keys []string
+}
+
+// pipelineKeys are the keys of a pipeline entry read by hana itself
+var pipelineKeys = []string{"name", "pipeline", "consumer", "parser", "datasource", "constlabels", "pushurl"}
+
+// Defaults of the server section
+const (
+	defaultListenAddress   = ":9091"
+	defaultMetricsPath     = "/metrics"
+	defaultCardinalityPath = "/debug/cardinality"
+	defaultDrainTimeout    = 10 * time.Second
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+// loadConfig reads config files, the server section is read from the first
+// file and the pipelines of all files are concatenated
+func loadConfig(paths []string) (*Config, error) {
+	c := &Config{}
+	for i, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.parse(content, i == 0); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseConfig parses the content of a single config file
+func parseConfig(content []byte) (*Config, error) {
+	c := &Config{}
+	if err := c.parse(content, true); err != nil {
+		return nil, err
+	}
+	c.setDefaults()
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parse adds the pipelines of a config file, the server section is only
+// allowed in the first file
+func (c *Config) parse(content []byte, first bool) error {
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return err
+	}
+	_, hasServer := raw["server"]
+	list, hasPipelines := raw["pipelines"]
+	if !hasServer && !hasPipelines {
+		if first {
+			c.Server.ListenAddress = stringValue(raw["listenaddress"])
+		}
+		delete(raw, "listenaddress")
+		p, err := newPipelineConfig(raw)
+		if err != nil {
+			return err
+		}
+		c.Pipelines = append(c.Pipelines, p)
+		return nil
+	}
+	for k := range raw {
+		if k != "server" && k != "pipelines" {
+			return fmt.Errorf("unknown key %q, expected server and pipelines", k)
+		}
+	}
+	if hasServer {
+		if !first {
+			return fmt.Errorf("server must be configured in the first config file")
+		}
+		if unknown := unknownKeys(raw["server"], reflect.TypeOf(ServerConfig{}), "server."); len(unknown) > 0 {
+			return fmt.Errorf("unknown keys %s", strings.Join(unknown, ", "))
+		}
+		var f struct {
+			Server ServerConfig `yaml:"server"`
+		}
+		if err := yaml.Unmarshal(content, &f); err != nil {
+			return fmt.Errorf("server: %v", err)
+		}
+		c.Server = f.Server
+	}
+	if !hasPipelines {
+		return nil
+	}
+	entries, ok := list.([]interface{})
+	if !ok {
+		return fmt.Errorf("pipelines must be a list")
+	}
+	for i, e := range entries {
+		m, ok := e.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("pipeline %d: must be a map", i+1)
+		}
+		entry := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			entry[stringValue(k)] = v
+		}
+		p, err := newPipelineConfig(entry)
+		if err != nil {
+			return fmt.Errorf("pipeline %d: %v", i+1, err)
+		}
+		c.Pipelines = append(c.Pipelines, p)
+	}
+	return nil
+}
+
+// newPipelineConfig resolves the name, consumer and parser of a pipeline
+// entry and encodes it as the config of its consumer and parser
+func newPipelineConfig(entry map[string]interface{}) (*PipelineConfig, error) {
+	keys := make([]string, 0, len(entry))
+	for k := range entry {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	name := stringValue(entry["name"])
+	if len(name) == 0 {
+		name = stringValue(entry["pipeline"])
+	}
+	if len(name) == 0 {
+		name = stringValue(entry["filepath"])
+	}
+	if len(name) > 0 {
+		entry["pipeline"] = name
+	}
+	if len(stringValue(entry["parser"])) == 0 && entry["datasource"] != nil {
+		entry["parser"] = entry["datasource"]
+	}
+	content, err := yaml.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	p := &PipelineConfig{}
+	if err := yaml.Unmarshal(content, p); err != nil {
+		return nil, err
+	}
+	p.Consumer = strings.ToLower(p.Consumer)
+	if len(p.Consumer) == 0 {
+		p.Consumer = "file"
+	}
+	p.Parser = strings.ToLower(p.Parser)
+	p.Conf = string(content)
+	p.keys = keys
+	return p, nil
+}
+
+// unknownKeys returns the keys of the YAML map raw which aren't yaml fields
+// of the struct type t, nested structs are checked as well
+func unknownKeys(raw interface{}, t reflect.Type, prefix string) []string {
+	m, ok := raw.(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if tag := strings.Split(f.Tag.Get("yaml"), ",")[0]; len(tag) > 0 && tag != "-" {
+			fields[tag] = f.Type
+		}
+	}
+	var unknown []string
+	for k, v := range m {
+		key := stringValue(k)
+		ft, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+		if ft.Kind() == reflect.Struct {
+			unknown = append(unknown, unknownKeys(v, ft, prefix+key+".")...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Server.ListenAddress) == 0 {
+		c.Server.ListenAddress = defaultListenAddress
+	}
+	if len(c.Server.MetricsPath) == 0 {
+		c.Server.MetricsPath = defaultMetricsPath
+	}
+	if len(c.Server.CardinalityPath) == 0 {
+		c.Server.CardinalityPath = defaultCardinalityPath
+	}
+	if c.Server.DrainTimeout == 0 {
+		c.Server.DrainTimeout = defaultDrainTimeout
+	}
+	if c.Server.ShutdownTimeout == 0 {
+		c.Server.ShutdownTimeout = defaultShutdownTimeout
+	}
+}
+
+func (c *Config) validate() error {
+	s := c.Server
+	if len(s.TLS.CertFile) == 0 != (len(s.TLS.KeyFile) == 0) {
+		return fmt.Errorf("server: tls needs both certfile and keyfile")
+	}
+	if s.DrainTimeout < 0 || s.ShutdownTimeout < 0 {
+		return fmt.Errorf("server: timeouts must be positive")
+	}
+	paths := map[string]bool{}
+	for _, path := range []string{s.MetricsPath, s.CardinalityPath, s.ReloadPath} {
+		if path == s.ReloadPath && len(path) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("server: path %q must start with /", path)
+		}
+		if paths[path] {
+			return fmt.Errorf("server: path %s is used twice", path)
+		}
+		paths[path] = true
+	}
+	if len(c.Pipelines) == 0 {
+		return fmt.Errorf("no pipeline is configured")
+	}
+	names := map[string]bool{}
+	for i, p := range c.Pipelines {
+		if len(p.Name) == 0 {
+			return fmt.Errorf("pipeline %d: name is missing", i+1)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("pipeline %s: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("pipeline %s: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p *PipelineConfig) validate() error {
+	if !contains(datasource.Names(), p.Consumer) {
+		return fmt.Errorf("unknown consumer %q, known: %s", p.Consumer, strings.Join(datasource.Names(), ", "))
+	}
+	if len(p.Parser) == 0 {
+		return fmt.Errorf("parser is missing")
+	}
+	if !contains(pusher.Names(), p.Parser) {
+		return fmt.Errorf("unknown parser %q, known: %s", p.Parser, strings.Join(pusher.Names(), ", "))
+	}
+	if consumerKeys, parserKeys := datasource.Keys(p.Consumer), pusher.Keys(p.Parser); consumerKeys != nil && parserKeys != nil {
+		var unknown []string
+		for _, k := range p.keys {
+			if !contains(pipelineKeys, k) && !contains(consumerKeys, k) && !contains(parserKeys, k) {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			return fmt.Errorf("unknown keys %s of consumer %s and parser %s", strings.Join(unknown, ", "), p.Consumer, p.Parser)
+		}
+	}
+	for name := range p.ConstLabels {
+		if !model.LabelName(name).IsValid() || name == pusher.PipelineLabel {
+			return fmt.Errorf("invalid constlabels name %q", name)
+		}
+	}
+	if len(p.PushURL) > 0 {
+		if u, err := url.Parse(p.PushURL); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("invalid pushurl %q", p.PushURL)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
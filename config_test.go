@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigLegacy(t *testing.T) {
+	cases := []struct {
+		config   string
+		name     string
+		consumer string
+		parser   string
+	}{
+		{"datasource:\n  asaka\nfilepath:\n  a.log", "a.log", "file", "asaka"},
+		{"datasource:\n  Asaka\nfilepath:\n  a.log", "a.log", "file", "asaka"},
+		{"datasource:\n  csv\nfilepath:\n  a.log\npipeline: c1", "c1", "file", "csv"},
+		{"consumer: file\nparser: gpumeta\nfilepath: g.csv", "g.csv", "file", "gpumeta"},
+		{"parser: gpumeta\ndatasource: asaka\nfilepath: g.csv", "g.csv", "file", "gpumeta"},
+		{"consumer: File\nparser: JSON\nfilepath: j.log", "j.log", "file", "json"},
+	}
+
+	for idx, c := range cases {
+		cfg, err := parseConfig([]byte(c.config))
+		if err != nil {
+			t.Errorf("Case #%d, actual: %v, expected: nil", idx+1, err)
+			continue
+		}
+		p := cfg.Pipelines[0]
+		if len(cfg.Pipelines) != 1 || p.Name != c.name || p.Consumer != c.consumer || p.Parser != c.parser {
+			t.Errorf("Case #%d, actual: %v %v %v, expected: %v %v %v",
+				idx+1, p.Name, p.Consumer, p.Parser, c.name, c.consumer, c.parser)
+		}
+		if cfg.Server.ListenAddress != defaultListenAddress || cfg.Server.MetricsPath != defaultMetricsPath ||
+			len(cfg.Server.ReloadPath) > 0 {
+			t.Errorf("Case #%d, actual: %+v, expected: defaults", idx+1, cfg.Server)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	content := `
+server:
+  listenaddress: :9100
+  tls:
+    certfile: hana.crt
+    keyfile: hana.key
+  metricspath: /prom
+pipelines:
+  - name: gpu0
+    parser: gpumeta
+    filepath: gpu0.csv
+    constlabels:
+      node: n1
+      rack: 2
+    pushurl: http://pushgateway:9091
+  - consumer: file
+    parser: asaka
+    filepath: asaka.log
+`
+	cfg, err := parseConfig([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cfg.Server
+	if s.ListenAddress != ":9100" || !s.TLS.Enabled() || s.TLS.KeyFile != "hana.key" ||
+		s.MetricsPath != "/prom" || s.CardinalityPath != defaultCardinalityPath {
+		t.Errorf("actual: %+v, expected: the server section with default cardinalitypath", s)
+	}
+	if len(cfg.Pipelines) != 2 {
+		t.Fatalf("actual: %d pipelines, expected: 2", len(cfg.Pipelines))
+	}
+	p := cfg.Pipelines[0]
+	if p.Name != "gpu0" || p.Parser != "gpumeta" || p.ConstLabels["rack"] != "2" || p.PushURL != "http://pushgateway:9091" {
+		t.Errorf("actual: %+v, expected: pipeline gpu0", p)
+	}
+	if !strings.Contains(p.Conf, "pipeline: gpu0") || !strings.Contains(p.Conf, "filepath: gpu0.csv") {
+		t.Errorf("actual: %q, expected: conf of pipeline gpu0", p.Conf)
+	}
+	if p := cfg.Pipelines[1]; p.Name != "asaka.log" || p.Consumer != "file" || p.Parser != "asaka" {
+		t.Errorf("actual: %+v, expected: pipeline asaka.log", p)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	cases := []struct {
+		config   string
+		expected string
+	}{
+		{"server:\n  listenaddress: :9100\n", "no pipeline is configured"},
+		{"datasource: asaka\n", "pipeline 1: name is missing"},
+		{"filepath: a.log\n", "pipeline a.log: parser is missing"},
+		{"filepath: a.log\nparser: unknown\n", `pipeline a.log: unknown parser "unknown"`},
+		{"filepath: a.log\nparser: asaka\nconsumer: kafka\n", `pipeline a.log: unknown consumer "kafka"`},
+		{"pipelines:\n  - {name: a, parser: asaka}\n  - {name: a, parser: csv}\n", "pipeline a: duplicate name"},
+		{"pipelines:\n  - {name: a, parser: asaka, constlabels: {pipeline: x}}\n", `pipeline a: invalid constlabels name "pipeline"`},
+		{"pipelines:\n  - {name: a, parser: asaka, constlabels: {0bad: x}}\n", `pipeline a: invalid constlabels name "0bad"`},
+		{"pipelines:\n  - {name: a, parser: asaka, pushurl: pushgateway}\n", `pipeline a: invalid pushurl "pushgateway"`},
+		{"pipelines:\n  a: b\n", "pipelines must be a list"},
+		{"pipelines:\n  - a\n", "pipeline 1: must be a map"},
+		{"server:\n  tls:\n    certfile: a.crt\npipelines:\n  - {name: a, parser: asaka}\n", "server: tls needs both certfile and keyfile"},
+		{"server:\n  metricspath: metrics\npipelines:\n  - {name: a, parser: asaka}\n", `server: path "metrics" must start with /`},
+		{"server:\n  metricspath: /m\n  cardinalitypath: /m\npipelines:\n  - {name: a, parser: asaka}\n", "server: path /m is used twice"},
+		{"server:\n  reloadpath: /metrics\npipelines:\n  - {name: a, parser: asaka}\n", "server: path /metrics is used twice"},
+		{"filepath: a.log\nparser: asaka\npushurll: http://pushgateway:9091\n", "pipeline a.log: unknown keys pushurll of consumer file and parser asaka"},
+		{"pipelines:\n  - {name: a, parser: csv, constlabel: {node: n1}, types: {}}\n", "pipeline a: unknown keys constlabel, types of consumer file and parser csv"},
+		{"server:\n  listenaddres: :9100\n  tls: {certfile: a.crt, key: a.key}\npipelines:\n  - {name: a, parser: asaka}\n", "unknown keys server.listenaddres, server.tls.key"},
+		{"pipeline:\n  - {name: a, parser: asaka}\nserver: {}\n", `unknown key "pipeline"`},
+	}
+
+	for idx, c := range cases {
+		_, err := parseConfig([]byte(c.config))
+		if err == nil || !strings.HasPrefix(err.Error(), c.expected) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, c.expected)
+		}
+	}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"a.conf", "datasource: asaka\nfilepath: a.log\nlistenaddress: :9200\n"},
+		{"b.conf", "datasource: gpumeta\nfilepath: b.csv\nlistenaddress: :9300\n"},
+		{"c.conf", "pipelines:\n  - {name: c, parser: csv}\n"},
+		{"d.conf", "server:\n  listenaddress: :9400\npipelines:\n  - {name: d, parser: csv}\n"},
+	}
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	cfg, err := loadConfig(paths[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.ListenAddress != ":9200" {
+		t.Errorf("actual: %s, expected: listen address of the first file :9200", cfg.Server.ListenAddress)
+	}
+	var names []string
+	for _, p := range cfg.Pipelines {
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, ",") != "a.log,b.csv,c" {
+		t.Errorf("actual: %v, expected: [a.log b.csv c]", names)
+	}
+
+	if _, err := loadConfig(paths); err == nil || !strings.Contains(err.Error(), "server must be configured in the first config file") {
+		t.Errorf("actual: %v, expected: server in later file rejected", err)
+	}
+}
@@ -3,10 +3,29 @@ Package datasource provides a common interface for different datasources
 */
 package datasource
 
+import (
+	"context"
+)
+
 // Consumer is interface defining how to consume data from a datasource
 type Consumer interface {
-	// Start a new consumer and returns a channel for returning data
-	Start() (chan string, error)
-	// Stop the consumer
+	// Start consuming until ctx is done or Stop is called, lines are sent to
+	// the returned channel, which is closed when the consumer ends
+	Start(ctx context.Context) (<-chan string, error)
+	// Stop the consumer and wait until it ended, Stop is idempotent and
+	// returns the error ending the consumer
 	Stop() error
+	// Done is closed when the consumer ended
+	Done() <-chan struct{}
+	// Errors receives errors of the datasource which don't end the consumer,
+	// it is closed when the consumer ended
+	Errors() <-chan error
+}
+
+// Drainer is implemented by consumers which can send the data they read
+// before they stop
+type Drainer interface {
+	// Drain stops the consumer like Stop, the lines it read are sent until
+	// ctx is done
+	Drain(ctx context.Context) error
 }
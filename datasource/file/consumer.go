@@ -0,0 +1,157 @@
+/*
+package file provides a consumer following a log file, such as the monitor
+data written by Asaka
+*/
+package file
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/ksang/hana/datasource"
+	"github.com/ksang/hana/lifecycle"
+	"github.com/olebedev/config"
+)
+
+// drainIdle is the time without a new line after which a draining consumer
+// assumes it reached the end of the file
+const drainIdle = 200 * time.Millisecond
+
+// consumer sends the lines appended to a file
+type consumer struct {
+	*lifecycle.Runner
+	filePath string
+
+	mu       sync.Mutex
+	drainCtx context.Context
+}
+
+func init() {
+	datasource.Register("file", New, "filepath")
+	// asaka is the former name of the file consumer
+	datasource.Register("asaka", New, "filepath")
+}
+
+// New creates a consumer following the file of the "filepath" key
+func New(conf string) (datasource.Consumer, error) {
+	cfg, err := config.ParseYaml(conf)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := cfg.String("filepath")
+	if err != nil {
+		return nil, err
+	}
+	return &consumer{
+		Runner:   lifecycle.NewRunner(),
+		filePath: fp,
+	}, nil
+}
+
+// Start follows the file, the consumer ends with the error of the tail if
+// it fails. Stop discards the lines which are read but not yet sent, Drain
+// sends them.
+func (c *consumer) Start(ctx context.Context) (<-chan string, error) {
+	ret := make(chan string, 1)
+	err := c.Runner.Start(ctx, func(ctx context.Context) error {
+		defer close(ret)
+		t, err := tail.TailFile(c.filePath, tail.Config{Follow: true})
+		if err != nil {
+			return err
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return stopTail(c.drainContext(), t, ret)
+			case line, ok := <-t.Lines:
+				if !ok {
+					if err := t.Wait(); err != nil {
+						return fmt.Errorf("failed to tail %s, %v", c.filePath, err)
+					}
+					return nil
+				}
+				if line.Err != nil {
+					c.Report(line.Err)
+					continue
+				}
+				text := strings.TrimSuffix(line.Text, "\r")
+				select {
+				case ret <- text:
+				case <-ctx.Done():
+					return stopTail(c.drainContext(), t, ret, text)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Drain stops the consumer, the lines up to the end of the file are sent
+// until ctx is done
+func (c *consumer) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.drainCtx = ctx
+	c.mu.Unlock()
+	return c.Stop()
+}
+
+// drainContext returns the context of Drain, a done context if the consumer
+// is stopped without draining
+func (c *consumer) drainContext() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drainCtx == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return c.drainCtx
+}
+
+// stopTail sends the pending lines and the lines t reads to ret until no line
+// was read for drainIdle or ctx is done, then it stops t and discards the
+// lines read meanwhile
+func stopTail(ctx context.Context, t *tail.Tail, ret chan<- string, pending ...string) error {
+	drained := ctx.Err() != nil
+	for _, text := range pending {
+		if drained {
+			break
+		}
+		select {
+		case ret <- text:
+		case <-ctx.Done():
+			drained = true
+		}
+	}
+	for !drained {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				return t.Wait()
+			}
+			if line.Err != nil {
+				continue
+			}
+			select {
+			case ret <- strings.TrimSuffix(line.Text, "\r"):
+			case <-ctx.Done():
+				drained = true
+			}
+		case <-time.After(drainIdle):
+			drained = true
+		case <-ctx.Done():
+			drained = true
+		}
+	}
+	t.Kill(nil)
+	for range t.Lines {
+	}
+	return t.Wait()
+}
@@ -0,0 +1,177 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ksang/hana/datasource"
+)
+
+func writeLogFile(path string, lines int) error {
+	fl, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer fl.Close()
+	for i := 0; i < lines; i++ {
+		data := fmt.Sprintf("%d,%d\n", i, time.Now().Unix())
+		if _, err := fl.WriteString(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRegisteredNames(t *testing.T) {
+	for idx, name := range []string{"file", "asaka"} {
+		cons, err := datasource.New(name, "filepath: test.log\n")
+		if _, ok := cons.(*consumer); err != nil || !ok {
+			t.Errorf("Case #%d, actual: %T %v, expected: file consumer", idx+1, cons, err)
+		}
+	}
+}
+
+func TestFileConsumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asaka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testLogFile := filepath.Join(dir, "test.log")
+
+	cons, err := New(fmt.Sprintf("filepath:\n  %s", testLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cons.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cons.Start(context.Background()); err == nil {
+		t.Error("actual: nil, expected: error starting twice")
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- writeLogFile(testLogFile, 20)
+	}()
+	for i := 0; i < 20; i++ {
+		select {
+		case line, ok := <-out:
+			if !ok {
+				t.Fatalf("Case #%d, output closed, %v", i+1, cons.Stop())
+			}
+			if expected := fmt.Sprintf("%d,", i); line[:len(expected)] != expected {
+				t.Errorf("Case #%d, actual: %v, expected prefix: %v", i+1, line, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Case #%d, line not read", i+1)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := cons.Stop(); err != nil {
+			t.Errorf("Stop #%d, actual: %v, expected: nil", i+1, err)
+		}
+	}
+	if _, ok := <-out; ok {
+		t.Error("output channel not closed after Stop")
+	}
+	select {
+	case <-cons.Done():
+	default:
+		t.Error("consumer not done after Stop")
+	}
+}
+
+func TestAsakaConsumerCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asaka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testLogFile := filepath.Join(dir, "test.log")
+	if err := writeLogFile(testLogFile, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	cons, err := New("filepath: " + testLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	out, err := cons.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lines are not read, the consumer must still end
+	cancel()
+	select {
+	case <-cons.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't end after its context was canceled")
+	}
+	for range out {
+	}
+	if err := cons.Stop(); err != nil {
+		t.Errorf("actual: %v, expected: nil", err)
+	}
+	if _, ok := <-cons.Errors(); ok {
+		t.Error("errors channel not closed")
+	}
+}
+
+func TestAsakaConsumerDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "asaka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testLogFile := filepath.Join(dir, "test.log")
+	if err := writeLogFile(testLogFile, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cons, err := New("filepath: " + testLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cons.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		t.Fatal("line not read")
+	}
+	// the tail misses writes until it watches the file at its end, lines
+	// written right before draining are sent afterwards
+	time.Sleep(100 * time.Millisecond)
+	if err := writeLogFile(testLogFile, 20); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cons.(*consumer).Drain(ctx)
+	}()
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 20 {
+		t.Errorf("actual: %v lines, expected: 20", n)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("actual: %v, expected: nil", err)
+	}
+}
@@ -0,0 +1,66 @@
+package datasource
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a consumer from its YAML config
+type Factory func(conf string) (Consumer, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+	factoryKeys = map[string][]string{}
+)
+
+// Register makes a consumer available by name, names are case insensitive.
+// keys are the config keys read by the consumer, configs with other keys are
+// rejected, they aren't checked if no keys are given. Register panics if it
+// is called twice with the same name or factory is nil.
+func Register(name string, factory Factory, keys ...string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("datasource: Register factory is nil")
+	}
+	name = strings.ToLower(name)
+	if _, dup := factories[name]; dup {
+		panic("datasource: Register called twice for " + name)
+	}
+	factories[name] = factory
+	factoryKeys[name] = keys
+}
+
+// New creates a consumer by the factory registered as name
+func New(name, conf string) (Consumer, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[strings.ToLower(name)]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown consumer %q", name)
+	}
+	return factory(conf)
+}
+
+// Keys returns the config keys of the consumer registered as name, nil if
+// they aren't declared
+func Keys(name string) []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	return factoryKeys[strings.ToLower(name)]
+}
+
+// Names returns the sorted names of the registered consumers
+func Names() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,656 @@
+/*
+Package demangle decodes C++ symbol names mangled by the Itanium C++ ABI,
+as used by gcc, clang and nvcc for CUDA kernels
+*/
+package demangle
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Symbol is a demangled function or data name
+type Symbol struct {
+	// Name is the readable name without return type,
+	// e.g. IFFT512_device<double2, double>(double2*)
+	Name string
+	// Base is the unqualified name without template arguments,
+	// e.g. IFFT512_device
+	Base string
+	// Namespace is the scope enclosing the name, e.g. cufft::detail
+	Namespace string
+}
+
+// ErrNotMangled is returned for names which are not Itanium mangled
+var ErrNotMangled = errors.New("not a mangled name")
+
+// Substitutions let a short mangled name expand exponentially, names longer
+// than maxNameLength or nested deeper than maxDepth are rejected
+const (
+	maxNameLength = 4096
+	maxDepth      = 256
+)
+
+// Demangle decodes a mangled name such as _Z14IFFT512_deviceI7double2dEvPT_,
+// names which would decode longer than 4KiB or nest deeper than 256 levels
+// are rejected
+func Demangle(mangled string) (sym *Symbol, err error) {
+	if !strings.HasPrefix(mangled, "_Z") {
+		return nil, ErrNotMangled
+	}
+	p := &parser{s: mangled, pos: 2}
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			sym, err = nil, perr
+		}
+	}()
+	sym = p.encoding()
+	// vendor specific suffixes such as .clone.1 are dropped
+	if p.pos < len(p.s) && p.s[p.pos] != '.' {
+		p.fail("unexpected trailing characters")
+	}
+	p.limit(sym.Name)
+	return sym, nil
+}
+
+type parseError struct {
+	msg string
+	pos int
+}
+
+func (e parseError) Error() string {
+	return fmt.Sprintf("demangle: %s at offset %d", e.msg, e.pos)
+}
+
+// name is a parsed <name> with the parts needed by Symbol
+type name struct {
+	full      string
+	base      string
+	scope     string
+	templated bool
+	// cv holds the qualifiers of member functions, e.g. " const"
+	cv string
+}
+
+type parser struct {
+	s    string
+	pos  int
+	subs []string
+	// depth is the nesting of names and types being parsed
+	depth int
+	// tmplArgs are the template arguments of the encoded function,
+	// referenced by template parameters
+	tmplArgs []string
+}
+
+func (p *parser) fail(msg string) {
+	panic(parseError{msg: msg, pos: p.pos})
+}
+
+func (p *parser) peek() byte {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *parser) peekAt(offset int) byte {
+	if p.pos+offset >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos+offset]
+}
+
+func (p *parser) consume(prefix string) bool {
+	if strings.HasPrefix(p.s[p.pos:], prefix) {
+		p.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(prefix string) {
+	if !p.consume(prefix) {
+		p.fail("expected " + prefix)
+	}
+}
+
+func (p *parser) addSub(s string) {
+	p.subs = append(p.subs, p.limit(s))
+}
+
+// limit returns s, it fails if s is longer than maxNameLength
+func (p *parser) limit(s string) string {
+	if len(s) > maxNameLength {
+		p.fail("name too long")
+	}
+	return s
+}
+
+// enter fails if the nesting exceeds maxDepth, leave must be deferred
+func (p *parser) enter() {
+	p.depth++
+	if p.depth > maxDepth {
+		p.fail("nested too deep")
+	}
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// encoding ::= <name> <bare-function-type> | <name>
+func (p *parser) encoding() *Symbol {
+	n := p.name(false, true)
+	sym := &Symbol{Name: n.full, Base: n.base, Namespace: n.scope}
+	if p.pos >= len(p.s) || p.peek() == '.' || p.peek() == 'E' {
+		// data name
+		return sym
+	}
+	if n.templated {
+		// template functions encode the return type first
+		p.typ()
+	}
+	sym.Name += "(" + p.parameters() + ")" + n.cv
+	return sym
+}
+
+// parameters parses types until the end of the function, "v" alone is empty
+func (p *parser) parameters() string {
+	if p.peek() == 'v' && (p.peekAt(1) == 0 || p.peekAt(1) == '.' || p.peekAt(1) == 'E') {
+		p.pos++
+		return ""
+	}
+	var params []string
+	for p.pos < len(p.s) && p.peek() != '.' && p.peek() != 'E' {
+		params = append(params, p.typ())
+	}
+	if len(params) == 0 {
+		p.fail("missing parameters")
+	}
+	return p.limit(strings.Join(params, ", "))
+}
+
+// name parses <name>, isType adds the complete name to substitutions,
+// top marks the name of the encoding whose template args are referenced by
+// template parameters
+func (p *parser) name(isType, top bool) name {
+	p.enter()
+	defer p.leave()
+	switch {
+	case p.peek() == 'N':
+		return p.nestedName(isType, top)
+	case p.peek() == 'Z':
+		p.fail("local names are not supported")
+	}
+	var n name
+	switch {
+	case p.peek() == 'S' && p.peekAt(1) != 't':
+		n.full = p.substitution()
+		n.base = n.full
+		if i := strings.LastIndex(n.full, "::"); i >= 0 {
+			n.scope, n.base = n.full[:i], n.full[i+2:]
+		}
+		if p.peek() != 'I' {
+			return n
+		}
+	default:
+		if p.consume("St") {
+			n.scope = "std"
+		}
+		n.base = p.unqualifiedName("")
+		n.full = n.base
+		if len(n.scope) > 0 {
+			n.full = n.scope + "::" + n.base
+		}
+		if p.peek() == 'I' {
+			// unscoped template name
+			p.addSub(n.full)
+		}
+	}
+	if p.peek() == 'I' {
+		args := p.templateArgs()
+		if top {
+			p.tmplArgs = args
+		}
+		n.full += formatArgs(args)
+		n.templated = true
+	}
+	if isType {
+		p.addSub(n.full)
+	}
+	return n
+}
+
+// nestedName ::= N [<CV-qualifiers>] [<ref-qualifier>] <prefix> <unqualified-name> E
+func (p *parser) nestedName(isType, top bool) name {
+	p.expect("N")
+	var n name
+	n.cv = p.cvQualifiers()
+	if p.consume("R") {
+		n.cv += " &"
+	} else if p.consume("O") {
+		n.cv += " &&"
+	}
+	var last string
+	for !p.consume("E") {
+		if p.pos >= len(p.s) {
+			p.fail("unterminated nested name")
+		}
+		if len(n.full) > 0 && last != "sub" {
+			p.addSub(n.full)
+		}
+		switch c := p.peek(); {
+		case c == 'I':
+			if len(n.full) == 0 {
+				p.fail("template args without name")
+			}
+			args := p.templateArgs()
+			if top {
+				p.tmplArgs = args
+			}
+			n.full += formatArgs(args)
+			n.templated = true
+			last = "args"
+		case c == 'S' && len(n.full) == 0:
+			if p.peekAt(1) == 't' {
+				p.pos += 2
+				n.full, n.base = "std", "std"
+				last = "std"
+				continue
+			}
+			n.full = p.substitution()
+			n.base = n.full
+			if i := strings.LastIndex(n.full, "::"); i >= 0 {
+				n.base = n.full[i+2:]
+			}
+			last = "sub"
+		case c == 'T' && len(n.full) == 0:
+			n.full = p.templateParam()
+			n.base = n.full
+			last = "param"
+		default:
+			base := p.unqualifiedName(n.base)
+			if len(n.full) > 0 {
+				n.scope = n.full
+				n.full += "::" + base
+			} else {
+				n.full = base
+			}
+			n.base = base
+			n.templated = false
+			last = "name"
+		}
+	}
+	if len(n.full) == 0 {
+		p.fail("empty nested name")
+	}
+	if isType {
+		p.addSub(n.full)
+	}
+	return n
+}
+
+// unqualifiedName ::= <source-name> | <ctor-dtor-name> | <operator-name>,
+// class is the enclosing name for constructors and destructors
+func (p *parser) unqualifiedName(class string) string {
+	c := p.peek()
+	switch {
+	case c >= '0' && c <= '9':
+		return p.sourceName()
+	case c == 'C' && p.peekAt(1) >= '1' && p.peekAt(1) <= '5':
+		p.pos += 2
+		return trimArgs(class)
+	case c == 'D' && p.peekAt(1) >= '0' && p.peekAt(1) <= '5':
+		p.pos += 2
+		return "~" + trimArgs(class)
+	case c == 'c' && p.peekAt(1) == 'v':
+		p.pos += 2
+		return "operator " + p.typ()
+	case p.pos+2 <= len(p.s):
+		if op, ok := operators[p.s[p.pos:p.pos+2]]; ok {
+			p.pos += 2
+			return "operator" + op
+		}
+	}
+	p.fail("unknown unqualified name")
+	return ""
+}
+
+func (p *parser) sourceName() string {
+	n := p.number()
+	if n <= 0 || p.pos+n > len(p.s) {
+		p.fail("invalid source name length")
+	}
+	id := p.s[p.pos : p.pos+n]
+	p.pos += n
+	if strings.HasPrefix(id, "_GLOBAL__N") {
+		return "(anonymous namespace)"
+	}
+	return id
+}
+
+func (p *parser) number() int {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		p.fail("expected number")
+	}
+	n := 0
+	for _, c := range p.s[start:p.pos] {
+		n = n*10 + int(c-'0')
+		if n > len(p.s) {
+			p.fail("number out of range")
+		}
+	}
+	return n
+}
+
+// cvQualifiers ::= [r] [V] [K]
+func (p *parser) cvQualifiers() string {
+	cv := ""
+	if p.consume("r") {
+		cv += " restrict"
+	}
+	if p.consume("V") {
+		cv += " volatile"
+	}
+	if p.consume("K") {
+		cv += " const"
+	}
+	return cv
+}
+
+// templateArgs ::= I <template-arg>+ E
+func (p *parser) templateArgs() []string {
+	p.expect("I")
+	var args []string
+	for !p.consume("E") {
+		if p.pos >= len(p.s) {
+			p.fail("unterminated template args")
+		}
+		args = append(args, p.templateArg())
+	}
+	return args
+}
+
+func (p *parser) templateArg() string {
+	p.enter()
+	defer p.leave()
+	switch p.peek() {
+	case 'L':
+		return p.literal()
+	case 'J':
+		// argument pack
+		p.pos++
+		var args []string
+		for !p.consume("E") {
+			if p.pos >= len(p.s) {
+				p.fail("unterminated argument pack")
+			}
+			args = append(args, p.templateArg())
+		}
+		return strings.Join(args, ", ")
+	case 'X':
+		p.fail("expressions are not supported")
+	}
+	return p.typ()
+}
+
+// literal ::= L <type> <value number> E
+func (p *parser) literal() string {
+	p.expect("L")
+	if p.peek() == '_' {
+		p.fail("external name literals are not supported")
+	}
+	t := p.typ()
+	neg := p.consume("n")
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != 'E' {
+		p.pos++
+	}
+	value := p.s[start:p.pos]
+	p.expect("E")
+	if neg {
+		value = "-" + value
+	}
+	switch t {
+	case "bool":
+		if value == "0" {
+			return "false"
+		}
+		return "true"
+	case "int":
+		return value
+	case "unsigned int":
+		return value + "u"
+	case "long":
+		return value + "l"
+	case "unsigned long":
+		return value + "ul"
+	case "long long":
+		return value + "ll"
+	case "unsigned long long":
+		return value + "ull"
+	}
+	return "(" + t + ")" + value
+}
+
+// substitution ::= S_ | S <seq-id> _ | St | Sa | Sb | Ss | Si | So | Sd
+func (p *parser) substitution() string {
+	p.expect("S")
+	if s, ok := stdSubstitutions[p.peek()]; ok {
+		p.pos++
+		return s
+	}
+	idx := 0
+	if !p.consume("_") {
+		start := p.pos
+		for p.pos < len(p.s) && p.s[p.pos] != '_' {
+			c := p.s[p.pos]
+			switch {
+			case c >= '0' && c <= '9':
+				idx = idx*36 + int(c-'0')
+			case c >= 'A' && c <= 'Z':
+				idx = idx*36 + int(c-'A') + 10
+			default:
+				p.fail("invalid substitution")
+			}
+			if idx > len(p.s) {
+				p.fail("substitution out of range")
+			}
+			p.pos++
+		}
+		if start == p.pos {
+			p.fail("invalid substitution")
+		}
+		p.expect("_")
+		idx++
+	}
+	if idx >= len(p.subs) {
+		p.fail("substitution out of range")
+	}
+	return p.subs[idx]
+}
+
+// templateParam ::= T_ | T <number> _
+func (p *parser) templateParam() string {
+	p.expect("T")
+	idx := 0
+	if !p.consume("_") {
+		idx = p.number() + 1
+		p.expect("_")
+	}
+	if idx >= len(p.tmplArgs) {
+		p.fail("template parameter out of range")
+	}
+	return p.tmplArgs[idx]
+}
+
+// typ parses <type>
+func (p *parser) typ() string {
+	p.enter()
+	defer p.leave()
+	c := p.peek()
+	if b, ok := builtinTypes[c]; ok {
+		p.pos++
+		return b
+	}
+	switch c {
+	case 'D':
+		if b, ok := builtinDTypes[p.peekAt(1)]; ok {
+			p.pos += 2
+			return b
+		}
+		p.fail("unsupported type")
+	case 'r', 'V', 'K':
+		cv := p.cvQualifiers()
+		t := p.typ() + cv
+		p.addSub(t)
+		return t
+	case 'P':
+		p.pos++
+		var t string
+		if p.peek() == 'F' {
+			ret, params := p.functionType()
+			t = ret + " (*)(" + params + ")"
+		} else {
+			t = p.typ() + "*"
+		}
+		p.addSub(t)
+		return t
+	case 'R', 'O':
+		p.pos++
+		ref := "&"
+		if c == 'O' {
+			ref = "&&"
+		}
+		t := p.typ() + ref
+		p.addSub(t)
+		return t
+	case 'F':
+		ret, params := p.functionType()
+		t := ret + " (" + params + ")"
+		p.addSub(t)
+		return t
+	case 'A':
+		p.pos++
+		dim := ""
+		if p.peek() != '_' {
+			dim = fmt.Sprint(p.number())
+		}
+		p.expect("_")
+		t := p.typ() + " [" + dim + "]"
+		p.addSub(t)
+		return t
+	case 'T':
+		t := p.templateParam()
+		p.addSub(t)
+		if p.peek() == 'I' {
+			t += formatArgs(p.templateArgs())
+			p.addSub(t)
+		}
+		return t
+	case 'S':
+		if p.peekAt(1) == 't' {
+			return p.name(true, false).full
+		}
+		t := p.substitution()
+		if p.peek() == 'I' {
+			t += formatArgs(p.templateArgs())
+			p.addSub(t)
+		}
+		return t
+	case 'N', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return p.name(true, false).full
+	}
+	p.fail("unsupported type")
+	return ""
+}
+
+// functionType ::= F [Y] <return type> <parameter types> E
+func (p *parser) functionType() (string, string) {
+	p.expect("F")
+	p.consume("Y")
+	ret := p.typ()
+	params := p.parameters()
+	p.expect("E")
+	return ret, params
+}
+
+func formatArgs(args []string) string {
+	s := "<" + strings.Join(args, ", ")
+	if strings.HasSuffix(s, ">") {
+		s += " "
+	}
+	return s + ">"
+}
+
+// trimArgs removes the template args of a name, e.g. for constructors
+func trimArgs(s string) string {
+	if i := strings.Index(s, "<"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+var builtinTypes = map[byte]string{
+	'v': "void",
+	'w': "wchar_t",
+	'b': "bool",
+	'c': "char",
+	'a': "signed char",
+	'h': "unsigned char",
+	's': "short",
+	't': "unsigned short",
+	'i': "int",
+	'j': "unsigned int",
+	'l': "long",
+	'm': "unsigned long",
+	'x': "long long",
+	'y': "unsigned long long",
+	'n': "__int128",
+	'o': "unsigned __int128",
+	'f': "float",
+	'd': "double",
+	'e': "long double",
+	'g': "__float128",
+	'z': "...",
+}
+
+var builtinDTypes = map[byte]string{
+	'h': "half",
+	'n': "decltype(nullptr)",
+	'i': "char32_t",
+	's': "char16_t",
+	'u': "char8_t",
+}
+
+var stdSubstitutions = map[byte]string{
+	'a': "std::allocator",
+	'b': "std::basic_string",
+	's': "std::string",
+	'i': "std::istream",
+	'o': "std::ostream",
+	'd': "std::iostream",
+}
+
+var operators = map[string]string{
+	"nw": " new", "na": " new[]", "dl": " delete", "da": " delete[]",
+	"ps": "+", "ng": "-", "ad": "&", "de": "*", "co": "~",
+	"pl": "+", "mi": "-", "ml": "*", "dv": "/", "rm": "%",
+	"an": "&", "or": "|", "eo": "^", "aS": "=",
+	"pL": "+=", "mI": "-=", "mL": "*=", "dV": "/=", "rM": "%=",
+	"aN": "&=", "oR": "|=", "eO": "^=",
+	"ls": "<<", "rs": ">>", "lS": "<<=", "rS": ">>=",
+	"eq": "==", "ne": "!=", "lt": "<", "gt": ">", "le": "<=", "ge": ">=",
+	"nt": "!", "aa": "&&", "oo": "||", "pp": "++", "mm": "--",
+	"cm": ",", "pm": "->*", "pt": "->", "cl": "()", "ix": "[]", "qu": "?",
+}
@@ -0,0 +1,83 @@
+package demangle
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDemangle(t *testing.T) {
+	cases := []struct {
+		mangled   string
+		name      string
+		base      string
+		namespace string
+	}{
+		{"_Z14IFFT512_deviceI7double2dEvPT_", "IFFT512_device<double2, double>(double2*)", "IFFT512_device", ""},
+		{"_Z13chk512_deviceI6float2EvPKT_iPc", "chk512_device<float2>(float2 const*, int, char*)", "chk512_device", ""},
+		{"_Z9vectorAddPKfS0_Pfi", "vectorAdd(float const*, float const*, float*, int)", "vectorAdd", ""},
+		{"_Z6kernelv", "kernel()", "kernel", ""},
+		{"_ZN5cufft6detail7fft_c2cILi512EEEvP6float2", "cufft::detail::fft_c2c<512>(float2*)", "fft_c2c", "cufft::detail"},
+		{"_ZN3foo3BarC2Ev", "foo::Bar::Bar()", "Bar", "foo::Bar"},
+		{"_ZNK3foo3Bar4sizeEv", "foo::Bar::size() const", "size", "foo::Bar"},
+		{"_ZN2ns6reduceINSt6vectorIiSaIiEEEEEvRKT_", "ns::reduce<std::vector<int, std::allocator<int> > >(std::vector<int, std::allocator<int> > const&)", "reduce", "ns"},
+		{"_Z5applyPFviEi", "apply(void (*)(int), int)", "apply", ""},
+		{"_ZN12_GLOBAL__N_16helperEv", "(anonymous namespace)::helper()", "helper", "(anonymous namespace)"},
+		{"_Z6kernelv.clone.1", "kernel()", "kernel", ""},
+	}
+	for i, c := range cases {
+		sym, err := Demangle(c.mangled)
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error: %v", i, err)
+			continue
+		}
+		if sym.Name != c.name || sym.Base != c.base || sym.Namespace != c.namespace {
+			t.Errorf("Case #%d, actual: %+v, expected: %s %s %s", i, *sym, c.name, c.base, c.namespace)
+		}
+	}
+}
+
+func TestDemangleInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"vectorAdd",
+		"_Z",
+		"_Z14IFFT512",
+		"_Z3fooIiEvT0_",
+		"_Z3fooS5_",
+		"_ZN3foo",
+		"_Z3fooILi5",
+		"_Z999999999999999999999a",
+	}
+	for i, c := range cases {
+		if sym, err := Demangle(c); err == nil {
+			t.Errorf("Case #%d, actual: %+v, expected: error", i, *sym)
+		}
+	}
+}
+
+func TestDemangleLimits(t *testing.T) {
+	// every template b<S, S> of the last one doubles the name
+	expanding := "_Z1f1a"
+	for i, last := 0, "S_"; i < 30; i++ {
+		expanding += "1bI" + last + last + "E"
+		last = "S" + strings.ToUpper(strconv.FormatInt(int64(2*i+1), 36)) + "_"
+	}
+	cases := []struct {
+		mangled string
+		err     string
+	}{
+		{expanding, "name too long"},
+		{"_Z1f" + strings.Repeat("P", 1000) + "i", "nested too deep"},
+	}
+	for i, c := range cases {
+		sym, err := Demangle(c.mangled)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Case #%d, actual: %v %v, expected: %v", i, sym, err, c.err)
+		}
+	}
+	// names below the limits are decoded
+	if _, err := Demangle("_Z1f" + strings.Repeat("P", 100) + "i"); err != nil {
+		t.Errorf("actual: %v, expected: nil", err)
+	}
+}
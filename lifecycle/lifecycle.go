@@ -0,0 +1,111 @@
+/*
+Package lifecycle runs the goroutine of a consumer or pusher under a context,
+reports its errors and stops it idempotently
+*/
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrStarted is returned by Start if the runner was started before
+var ErrStarted = errors.New("already started")
+
+// errorsBuffer is the number of errors kept until they are received
+const errorsBuffer = 16
+
+// Runner runs a function in a goroutine until its context is done. Errors
+// occurring while running are reported on the Errors channel, the error
+// ending the function is returned by Stop and Err.
+type Runner struct {
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	errCh   chan error
+	err     error
+}
+
+// NewRunner creates a runner which is not started
+func NewRunner() *Runner {
+	return &Runner{
+		done:  make(chan struct{}),
+		errCh: make(chan error, errorsBuffer),
+	}
+}
+
+// Start runs fn in a goroutine with a context derived from ctx, which is
+// canceled by Stop. A runner can only be started once.
+func (r *Runner) Start(ctx context.Context, fn func(ctx context.Context) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return ErrStarted
+	}
+	r.started = true
+	ctx, r.cancel = context.WithCancel(ctx)
+	go func() {
+		err := fn(ctx)
+		if err == context.Canceled {
+			err = nil
+		}
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+		close(r.errCh)
+		close(r.done)
+	}()
+	return nil
+}
+
+// Stop cancels the function and waits until it returned, it returns the
+// error ending the function. Stop can be called any number of times, it
+// returns nil if the runner was never started.
+func (r *Runner) Stop() error {
+	r.mu.Lock()
+	if !r.started {
+		r.started = true
+		close(r.errCh)
+		close(r.done)
+		r.mu.Unlock()
+		return nil
+	}
+	cancel := r.cancel
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	<-r.done
+	return r.Err()
+}
+
+// Done is closed when the function returned or the runner was stopped
+// before it started
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error ending the function, nil while it runs
+func (r *Runner) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Errors receives errors reported while running, it is closed when the
+// function returned
+func (r *Runner) Errors() <-chan error {
+	return r.errCh
+}
+
+// Report sends err on the Errors channel, it is dropped if the buffer is full
+// as errors must not block the running function. Report must only be called
+// by the running function.
+func (r *Runner) Report(err error) {
+	select {
+	case r.errCh <- err:
+	default:
+	}
+}
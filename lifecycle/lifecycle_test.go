@@ -0,0 +1,107 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunner(t *testing.T) {
+	errFailed := errors.New("failed")
+	cases := []struct {
+		fn       func(ctx context.Context) error
+		cancel   bool
+		expected error
+	}{
+		// ends by Stop
+		{func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }, false, nil},
+		// ends by the parent context
+		{func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }, true, nil},
+		// ends by itself
+		{func(ctx context.Context) error { return errFailed }, false, errFailed},
+		// ends by Stop with an error
+		{func(ctx context.Context) error { <-ctx.Done(); return errFailed }, false, errFailed},
+	}
+
+	for idx, c := range cases {
+		r := NewRunner()
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := r.Start(ctx, c.fn); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Start(ctx, c.fn); err != ErrStarted {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, ErrStarted)
+		}
+		if c.cancel {
+			cancel()
+			<-r.Done()
+		}
+		// concurrent Stops all wait and return the same error
+		var wg sync.WaitGroup
+		errs := make([]error, 3)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = r.Stop()
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != c.expected {
+				t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, c.expected)
+			}
+		}
+		if err := r.Err(); err != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, c.expected)
+		}
+		cancel()
+	}
+}
+
+func TestRunnerErrors(t *testing.T) {
+	r := NewRunner()
+	release := make(chan struct{})
+	err := r.Start(context.Background(), func(ctx context.Context) error {
+		for i := 0; i < errorsBuffer+10; i++ {
+			r.Report(errors.New("line error"))
+		}
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	select {
+	case <-r.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("runner not done")
+	}
+	n := 0
+	for range r.Errors() {
+		n++
+	}
+	if n != errorsBuffer {
+		t.Errorf("actual: %d, expected: %d errors kept", n, errorsBuffer)
+	}
+}
+
+func TestRunnerStopBeforeStart(t *testing.T) {
+	r := NewRunner()
+	for i := 0; i < 2; i++ {
+		if err := r.Stop(); err != nil {
+			t.Errorf("Stop #%d, actual: %v, expected: nil", i+1, err)
+		}
+	}
+	select {
+	case <-r.Done():
+	default:
+		t.Error("runner not done")
+	}
+	if err := r.Start(context.Background(), func(context.Context) error { return nil }); err != ErrStarted {
+		t.Errorf("actual: %v, expected: %v", err, ErrStarted)
+	}
+}
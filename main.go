@@ -1,29 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
-	"github.com/ksang/hana/datasource/asaka"
+	_ "github.com/ksang/hana/datasource/file"
 	"github.com/ksang/hana/pusher"
-	"github.com/olebedev/config"
 	"github.com/prometheus/client_golang/prometheus"
-)
-
-type DataSourceType int
-
-const (
-	_ DataSourceType = iota
-	ASAKA
-	GPUMETA
-	UNKNOWN
+	"github.com/prometheus/common/expfmt"
 )
 
 var (
@@ -31,92 +24,82 @@ var (
 )
 
 func init() {
-	flag.StringVar(&configFile, "d", "hana.conf", "configuration file location, use comma if you have multiple config files, listen address should be defined in first config file.")
+	flag.StringVar(&configFile, "d", "hana.conf", "configuration file location, use comma if you have multiple config files, the server section should be defined in first config file.")
 }
 
-func ParseDataSource(s string) DataSourceType {
-	cfg, err := config.ParseYaml(s)
-	if err != nil {
-		log.Fatal("Failed to parse yaml config, err:", err)
-	}
-	ds, err := cfg.String("datasource")
-	if err != nil {
-		log.Fatal("Failed to get datasource type from config", err)
-	}
-	switch strings.ToLower(ds) {
-	case "asaka":
-		return ASAKA
-	case "gpumeta":
-		return GPUMETA
-	default:
-		return UNKNOWN
-	}
+// metricsHandler exposes the metrics merged from all pipelines, inconsistent
+// metrics are logged and skipped
+func metricsHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := g.Gather()
+		if err != nil {
+			log.Println("error gathering metrics,", err)
+		}
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				log.Println("error encoding metrics,", err)
+				return
+			}
+		}
+	})
 }
 
-func main() {
-	flag.Parse()
-	confFileList := strings.Split(configFile, ",")
-	var conf string
-	for _, confFile := range confFileList {
-		cfg, err := ioutil.ReadFile(confFile)
+// cardinalityHandler reports the series count of every metric and the label
+// values driving it, the number of values per label is set by "top"
+func cardinalityHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || top <= 0 {
+			top = 10
+		}
+		report, err := pusher.CardinalityReport(g, top)
 		if err != nil {
-			log.Fatal(err)
+			log.Println("error gathering metrics,", err)
 		}
-		conf := string(cfg)
-		ds := ParseDataSource(conf)
-		switch ds {
-		case ASAKA:
-			consumer, err1 := asaka.New(conf)
-			if err1 != nil {
-				log.Fatal(err)
-			}
-			dataCh, err1 := consumer.Start()
-			if err1 != nil {
-				log.Fatal(err)
-			}
-			pusher, err1 := pusher.NewAsaka(conf)
-			if err1 != nil {
-				log.Fatal(err)
-			}
-			err1 = pusher.Start(dataCh)
-			if err1 != nil {
-				log.Fatal(err)
-			}
-		case GPUMETA:
-			consumer, err1 := asaka.New(conf)
-			if err1 != nil {
-				log.Fatal(err)
-			}
-			dataCh, err1 := consumer.Start()
-			if err1 != nil {
-				log.Fatal(err)
-			}
-			pusher, err1 := pusher.NewGPUMeta(conf)
-			if err1 != nil {
-				log.Fatal(err)
-			}
-			err1 = pusher.Start(dataCh)
-			if err1 != nil {
-				log.Fatal(err)
-			}
-		default:
-			log.Println("Unknown datasource type")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Println("error encoding cardinality report,", err)
+		}
+	})
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdout, os.Stderr))
 		}
 	}
-	ymalcfg, err := config.ParseYaml(conf)
+	flag.Parse()
+	pipelines := newPipelineSet(strings.Split(configFile, ","))
+	cfg, err := pipelines.reload()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("failed to start pipelines, ", err)
 	}
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, pipelines}
 
-	addr, err := ymalcfg.String("listenaddress")
-	if err != nil {
-		addr = ":9091"
+	server := cfg.Server
+	mux := http.NewServeMux()
+	mux.Handle(server.MetricsPath, metricsHandler(gatherers))
+	mux.Handle(server.CardinalityPath, cardinalityHandler(gatherers))
+	if len(server.ReloadPath) > 0 {
+		mux.Handle(server.ReloadPath, reloadHandler(pipelines))
 	}
-	http.Handle("/metrics", prometheus.Handler())
+	srv := &http.Server{Addr: server.ListenAddress, Handler: mux}
 	go func() {
-		log.Fatal(http.ListenAndServe(addr, nil))
+		var err error
+		if server.TLS.Enabled() {
+			err = srv.ListenAndServeTLS(server.TLS.CertFile, server.TLS.KeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
-	log.Println("Hana started at", addr+"/metrics")
+	log.Println("Hana started at", server.ListenAddress+server.MetricsPath)
 	sigs := make(chan os.Signal, 1)
 	done := make(chan struct{}, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -125,6 +108,38 @@ func main() {
 		<-sigs
 		done <- struct{}{}
 	}()
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			if _, err := pipelines.reload(); err != nil {
+				log.Println("failed to reload config,", err)
+				continue
+			}
+			log.Println("config reloaded")
+		}
+	}()
 	<-done
 	fmt.Println("Signaled to terminate.")
+	os.Exit(shutdown(pipelines, srv, server))
+}
+
+// shutdown drains the pipelines and then closes the http server, so metrics
+// stay available while draining. The exit code is 1 if either didn't complete
+// in its timeout.
+func shutdown(pipelines *pipelineSet, srv *http.Server, server ServerConfig) int {
+	code := 0
+	ctx, cancel := context.WithTimeout(context.Background(), server.DrainTimeout)
+	defer cancel()
+	if err := pipelines.shutdown(ctx); err != nil {
+		log.Println("failed to drain pipelines,", err)
+		code = 1
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("failed to shut down http server,", err)
+		code = 1
+	}
+	return code
 }
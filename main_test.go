@@ -1,23 +1,63 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestParseDataSource(t *testing.T) {
-	cases := []struct {
-		config   string
-		expected DataSourceType
-	}{
-		{"datasource:\n  unknown", UNKNOWN},
-		{"datasource:\n  asaka", ASAKA},
-		{"datasource:\n  Asaka", ASAKA},
+func TestNewPipelineUnknown(t *testing.T) {
+	cases := []*PipelineConfig{
+		{Name: "a", Consumer: "file", Parser: "unknown", Conf: "filepath: a.log\n"},
+		{Name: "a", Consumer: "unknown", Parser: "asaka", Conf: "filepath: a.log\n"},
 	}
 
 	for idx, c := range cases {
-		res := ParseDataSource(c.config)
-		if res != c.expected {
-			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		if _, err := newPipeline(c); err == nil {
+			t.Errorf("Case #%d, actual: %v, expected: error", idx+1, err)
 		}
 	}
 }
+
+// TestShutdownPushes checks the SIGINT and SIGTERM path performs the final
+// push and deletes the group of pipelines with pushdelete
+func TestShutdownPushes(t *testing.T) {
+	var methods []string
+	var mu sync.Mutex
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+	}))
+	defer gateway.Close()
+	dir := writeTestFiles(t, map[string]string{"a.log": ""})
+	defer os.RemoveAll(dir)
+	confPath := filepath.Join(dir, "hana.conf")
+	conf := fmt.Sprintf("filepath: %s\nparser: asaka\npushurl: '%s'\npushinterval: 1h\npushdelete: true\n",
+		filepath.Join(dir, "a.log"), gateway.URL)
+	if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pipelines := newPipelineSet([]string{confPath})
+	if _, err := pipelines.reload(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Addr: "127.0.0.1:0"}
+	server := ServerConfig{DrainTimeout: 5 * time.Second, ShutdownTimeout: time.Second}
+	if code := shutdown(pipelines, srv, server); code != 0 {
+		t.Errorf("actual: %v, expected: 0", code)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{http.MethodPut, http.MethodDelete}
+	if fmt.Sprint(methods) != fmt.Sprint(expected) {
+		t.Errorf("actual: %v, expected: %v", methods, expected)
+	}
+}
@@ -0,0 +1,104 @@
+package pusher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/olebedev/config"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultAPINameMapInterval is how often the mapping file is checked for changes
+const defaultAPINameMapInterval = 10 * time.Second
+
+// apiNameMap translates numeric asaka API identifiers into names:
+//
+//	apinamemap:          inline map of API id to name
+//	apinamemapfile:      YAML file of API id to name, overriding inline entries
+//	apinamemapinterval:  interval of checking the file for changes, default 10s
+//
+// Unknown identifiers are passed through unchanged.
+type apiNameMap struct {
+	inline   map[string]string
+	file     string
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	names     map[string]string
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newAPINameMap(cfg *config.Config) (*apiNameMap, error) {
+	interval, err := time.ParseDuration(cfg.UString("apinamemapinterval", defaultAPINameMapInterval.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid apinamemapinterval, %v", err)
+	}
+	m := &apiNameMap{
+		inline:   map[string]string{},
+		file:     cfg.UString("apinamemapfile"),
+		interval: interval,
+		now:      time.Now,
+	}
+	for id, name := range cfg.UMap("apinamemap") {
+		m.inline[id] = stringValue(name)
+	}
+	m.names = m.inline
+	if len(m.file) > 0 {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// load reads the mapping file if it changed since last load
+func (m *apiNameMap) load() error {
+	m.lastCheck = m.now()
+	info, err := os.Stat(m.file)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(m.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(m.file)
+	if err != nil {
+		return err
+	}
+	// ids are usually unquoted numbers, which config doesn't accept as keys
+	fileNames := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(data, &fileNames); err != nil {
+		return fmt.Errorf("%s is not a map of API id to name, %v", m.file, err)
+	}
+	names := map[string]string{}
+	for id, name := range m.inline {
+		names[id] = name
+	}
+	for id, name := range fileNames {
+		names[stringValue(id)] = stringValue(name)
+	}
+	m.names = names
+	m.modTime = info.ModTime()
+	return nil
+}
+
+// lookup returns the name of API id, or id if it is unknown
+func (m *apiNameMap) lookup(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.file) > 0 && m.now().Sub(m.lastCheck) >= m.interval {
+		if err := m.load(); err != nil {
+			log.Println("failed to reload apinamemapfile,", err)
+		}
+	}
+	if name, ok := m.names[id]; ok {
+		return name
+	}
+	return id
+}
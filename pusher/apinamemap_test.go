@@ -0,0 +1,72 @@
+package pusher
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+var (
+	testAPINameMapFile = "apinamemap_test.yaml"
+)
+
+func TestAPINameMap(t *testing.T) {
+	if err := ioutil.WriteFile(testAPINameMapFile, []byte("1: cuInit\n2: cuMemAlloc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testAPINameMapFile)
+
+	p, err := NewAsaka(asaka_conf + "pushurl: http://127.0.0.1:9091\napinamemapfile: " + testAPINameMapFile + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.(*asaka)
+	now := time.Now()
+	a.apiNames.now = func() time.Time { return now }
+
+	cases := []struct {
+		id       string
+		expected string
+	}{
+		{"1", "cuInit"},
+		{"2", "cuMemAlloc"},
+		{"5", "API_5"},
+		{"cuda_init", "cuda_init"},
+	}
+	for idx, c := range cases {
+		if res := a.apiNames.lookup(c.id); res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+
+	a.ParseAndPush("1502970051,1,0,2,1,2,1,0")
+	if _, ok := gatheredValue(t, p, "asaka_api_call_count", map[string]string{"api": "cuInit"}); !ok {
+		t.Error("api label is not mapped")
+	}
+
+	if err := ioutil.WriteFile(testAPINameMapFile, []byte("1: cuInit_v2\n5: cuLaunch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := now.Add(time.Minute)
+	if err := os.Chtimes(testAPINameMapFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if res := a.apiNames.lookup("1"); res != "cuInit" {
+		t.Errorf("reloaded before interval, actual: %v", res)
+	}
+	now = now.Add(time.Minute)
+	cases = []struct {
+		id       string
+		expected string
+	}{
+		{"1", "cuInit_v2"},
+		{"2", "2"},
+		{"5", "cuLaunch"},
+	}
+	for idx, c := range cases {
+		if res := a.apiNames.lookup(c.id); res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+}
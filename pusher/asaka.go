@@ -1,13 +1,13 @@
 package pusher
 
 import (
-	"errors"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/olebedev/config"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 type AsakaLogType int
@@ -19,209 +19,234 @@ const (
 )
 
 type asaka struct {
-	pushUrl string
-	source  chan string
-	quitCh  chan struct{}
-	running bool
+	*base
+
+	lineTime    *lineTime
+	apiNames    *apiNameMap
+	kernelNames *kernelNames
+	derived     *asakaDerived
+
+	apiLatency    *asakaLatency
+	kernelLatency *asakaLatency
+
+	apiRuntimeMetric      *metric
+	apiCallcountMetric    *metric
+	apiTotalsizeMetric    *metric
+	kernelRuntimeMetric   *metric
+	kernelCallcountMetric *metric
+	kernelBlocknumMetric  *metric
+	kernelThreadnumMetric *metric
 }
 
 var (
-	apiLabelList     = []string{"session", "client_id", "api"}
-	apiRuntimeMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_api_running_time",
-			Help: "api total running time",
-		},
-		apiLabelList,
-	)
-	apiCallcountMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_api_call_count",
-			Help: "api total call count",
-		},
-		apiLabelList,
-	)
-	apiTotalsizeMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_api_total_size",
-			Help: "api total size",
-		},
-		apiLabelList,
-	)
-
-	kernelLabelList     = []string{"session", "client_id", "name"}
-	kernelRuntimeMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_kernel_running_time",
-			Help: "kernel total running time",
-		},
-		kernelLabelList,
-	)
-	kernelCallcountMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_kernel_call_count",
-			Help: "kernel total call count",
-		},
-		kernelLabelList,
-	)
-	kernelBlocknumMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_kernel_block_num",
-			Help: "kernel total block num",
-		},
-		kernelLabelList,
-	)
-	kernelThreadnumMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "asaka_kernel_thread_num",
-			Help: "kernel total thread num",
-		},
-		kernelLabelList,
-	)
+	apiLabelList    = []string{"session", "client_id", "api"}
+	kernelLabelList = []string{"session", "client_id", "name"}
 )
 
+// NewAsaka creates the asaka pusher, values are exposed as gauges unless
+// the "accumulation" map configures a metric as counter:
+//
+//	accumulation:
+//	  asaka_api_call_count: cumulative
+//	  asaka_kernel_running_time: delta
+//
+// cumulative values are tracked per series and restart from the raw value
+// when it decreases, delta values are added to the counter.
 func NewAsaka(conf string) (Pusher, error) {
 	cfg, err := config.ParseYaml(conf)
 	if err != nil {
 		return nil, err
 	}
-	pushurl, err := cfg.String("pushurl")
+	accumulation := cfg.UMap("accumulation")
+	a := &asaka{kernelNames: newKernelNames(cfg)}
+	kernelLabels := a.kernelNames.labelNames()
+	declared := map[string]bool{}
+	for _, d := range []struct {
+		m          **metric
+		name       string
+		help       string
+		labelNames []string
+	}{
+		{&a.apiRuntimeMetric, "asaka_api_running_time", "api total running time", apiLabelList},
+		{&a.apiCallcountMetric, "asaka_api_call_count", "api total call count", apiLabelList},
+		{&a.apiTotalsizeMetric, "asaka_api_total_size", "api total size", apiLabelList},
+		{&a.kernelRuntimeMetric, "asaka_kernel_running_time", "kernel total running time", kernelLabels},
+		{&a.kernelCallcountMetric, "asaka_kernel_call_count", "kernel total call count", kernelLabels},
+		{&a.kernelBlocknumMetric, "asaka_kernel_block_num", "kernel total block num", kernelLabels},
+		{&a.kernelThreadnumMetric, "asaka_kernel_thread_num", "kernel total thread num", kernelLabels},
+	} {
+		*d.m, err = asakaMetric(accumulation, d.name, d.help, d.labelNames)
+		if err != nil {
+			return nil, err
+		}
+		declared[d.name] = true
+	}
+	for name := range accumulation {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown asaka metric %s in accumulation", name)
+		}
+	}
+
+	a.derived, err = newAsakaDerived(cfg, kernelLabels)
 	if err != nil {
-		pushurl = ""
+		return nil, err
+	}
+	a.apiLatency, err = newAsakaLatency(cfg, "api", apiLabelList)
+	if err != nil {
+		return nil, err
+	}
+	a.kernelLatency, err = newAsakaLatency(cfg, "kernel", kernelLabels)
+	if err != nil {
+		return nil, err
+	}
+	a.lineTime, err = newLineTime(cfg, timestampUnix)
+	if err != nil {
+		return nil, err
+	}
+	a.apiNames, err = newAPINameMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.base, err = newBase(cfg, a.ParseAndPush)
+	if err != nil {
+		return nil, err
 	}
 	// Metrics have to be registered to be exposed:
-	prometheus.MustRegister(apiRuntimeMetric)
-	prometheus.MustRegister(apiCallcountMetric)
-	prometheus.MustRegister(apiTotalsizeMetric)
-	prometheus.MustRegister(kernelRuntimeMetric)
-	prometheus.MustRegister(kernelCallcountMetric)
-	prometheus.MustRegister(kernelBlocknumMetric)
-	prometheus.MustRegister(kernelThreadnumMetric)
-
-	return &asaka{
-		pushUrl: pushurl,
-		quitCh:  make(chan struct{}, 1),
-	}, nil
-}
-
-func (a *asaka) Start(src chan string) error {
-	a.source = src
-	go func() {
-		for {
-			select {
-			case <-a.quitCh:
-				a.running = false
-				return
-			case line := <-a.source:
-				a.ParseAndPush(line)
-			}
+	a.registry.MustRegister(a.lineTime.collectors()...)
+	ms := []*metric{
+		a.apiRuntimeMetric,
+		a.apiCallcountMetric,
+		a.apiTotalsizeMetric,
+		a.kernelRuntimeMetric,
+		a.kernelCallcountMetric,
+		a.kernelBlocknumMetric,
+		a.kernelThreadnumMetric,
+	}
+	ms = append(ms, a.derived.metrics()...)
+	for _, l := range []*asakaLatency{a.apiLatency, a.kernelLatency} {
+		if l != nil {
+			ms = append(ms, l.metrics()...)
 		}
-	}()
-	return nil
+	}
+	if err := a.registerMetrics(ms...); err != nil {
+		return nil, err
+	}
+
+	if err := a.checkMetricNames(); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
-func (a *asaka) Stop() error {
-	if !a.running {
-		return errors.New("not running")
+// asakaMetric creates an asaka metric with the accumulation configured for
+// its name: gauge (default), cumulative or delta
+func asakaMetric(accumulation map[string]interface{}, name, help string, labelNames []string) (*metric, error) {
+	spec := metricSpec{name: name, help: help, typ: metricTypeGauge}
+	switch mode := strings.ToLower(stringValue(accumulation[name])); mode {
+	case "", metricTypeGauge:
+	case accumulationCumulative, accumulationDelta:
+		spec.typ = metricTypeCounter
+		spec.accumulation = mode
+	default:
+		return nil, fmt.Errorf("unknown accumulation %q of metric %s", mode, name)
 	}
-	a.quitCh <- struct{}{}
-	return nil
+	return newMetric(spec, labelNames), nil
 }
 
+// ParseAndPush validates a line by the schema of its record type and sets
+// the metrics of it, rejected lines are counted by hana_parse_errors_total
 func (a *asaka) ParseAndPush(data string) {
+	if len(strings.TrimSpace(data)) == 0 {
+		// ignore
+		return
+	}
 	dataList := strings.Split(data, ",")
 	if len(dataList) < 2 {
-		// ignore
+		a.parseError(data, reasonShortLine, fmt.Errorf("%d fields", len(dataList)))
 		return
 	}
 	logType, err := strconv.ParseInt(dataList[1], 10, 8)
 	if err != nil {
-		log.Println("failed to parse asaka log type,", err)
+		a.parseError(data, reasonInvalidType, err)
 		return
 	}
-	switch AsakaLogType(logType) {
-	case MONITOR_API:
-		a.parseAndPushAPI(dataList)
-	case MONITOR_KERNEL:
-		a.parseAndPushKernel(dataList)
-	default:
-		log.Println("unknown asaka log type,", logType)
-	}
-	return
-}
-
-func (a *asaka) parseAndPushAPI(dataList []string) {
-	sessid := dataList[2]
-	clientid := dataList[3]
-	apiname := dataList[4]
-	runtime, err := strconv.ParseUint(dataList[5], 10, 64)
-	if err != nil {
-		log.Println("data format error for parsing running time,", err)
+	schema, ok := asakaSchemas[AsakaLogType(logType)]
+	if !ok {
+		a.parseError(data, reasonUnknownType, fmt.Errorf("unknown asaka log type %d", logType))
 		return
 	}
-	callcount, err := strconv.ParseUint(dataList[6], 10, 64)
+	rec, reason, err := schema.validate(dataList)
 	if err != nil {
-		log.Println("data format error for parsing calling count,", err)
+		a.parseError(data, reason, err)
 		return
 	}
-	size, err := strconv.ParseUint(dataList[7], 10, 64)
+	ts, ok, err := a.lineTime.check(dataList[0])
 	if err != nil {
-		log.Println("data format error for parsing size,", err)
+		a.parseError(data, reasonInvalidTimestamp, err)
 		return
 	}
-	if len(a.pushUrl) == 0 {
-		log.Printf("data parsed: SESS: %s CLIENT_ID: %s API_NAME: %s RUNTIME: %d CALLCOUNT: %d SIZE: %d",
-			sessid, clientid, apiname, runtime, callcount, size)
+	if !ok {
+		// too old
 		return
 	}
-	labels := prometheus.Labels{
-		"session":   sessid,
-		"client_id": clientid,
-		"api":       apiname,
+	switch AsakaLogType(logType) {
+	case MONITOR_API:
+		a.parseAndPushAPI(rec, ts)
+	case MONITOR_KERNEL:
+		a.parseAndPushKernel(rec, ts)
 	}
-
-	apiRuntimeMetric.With(labels).Set(float64(runtime))
-	apiCallcountMetric.With(labels).Set(float64(callcount))
-	apiTotalsizeMetric.With(labels).Set(float64(size))
 }
 
-func (a *asaka) parseAndPushKernel(dataList []string) {
-	sessid := dataList[2]
-	clientid := dataList[3]
-	kernelname := dataList[5]
-	runtime, err := strconv.ParseUint(dataList[6], 10, 64)
-	if err != nil {
-		log.Println("data format error for parsing running time,", err)
-		return
-	}
-	callcount, err := strconv.ParseUint(dataList[7], 10, 64)
-	if err != nil {
-		log.Println("data format error for parsing calling count,", err)
-		return
-	}
-	blocknum, err := strconv.ParseUint(dataList[8], 10, 64)
-	if err != nil {
-		log.Println("data format error for parsing blocknum,", err)
+func (a *asaka) parseAndPushAPI(rec *asakaRecord, ts time.Time) {
+	sessid := rec.field("session")
+	clientid := rec.field("client_id")
+	apiname := a.apiNames.lookup(rec.field("api"))
+	runtime := rec.number("running_time")
+	callcount := rec.number("call_count")
+	size := rec.number("total_size")
+	if a.logParsed {
+		log.Printf("data parsed: SESS: %s CLIENT_ID: %s API_NAME: %s RUNTIME: %d CALLCOUNT: %d SIZE: %d",
+			sessid, clientid, apiname, runtime, callcount, size)
 		return
 	}
-	threadnum, err := strconv.ParseUint(dataList[9], 10, 64)
-	if err != nil {
-		log.Println("data format error for parsing threadnum,", err)
-		return
+	lvs := []string{sessid, clientid, apiname}
+
+	a.push(a.apiRuntimeMetric, lvs, runtime, ts)
+	a.push(a.apiCallcountMetric, lvs, callcount, ts)
+	a.push(a.apiTotalsizeMetric, lvs, size, ts)
+	a.derived.pushAPI(lvs, apiname, runtime, callcount, size, ts)
+	if a.apiLatency != nil {
+		a.apiLatency.observe(lvs, runtime, callcount)
 	}
-	if len(a.pushUrl) == 0 {
+}
+
+func (a *asaka) parseAndPushKernel(rec *asakaRecord, ts time.Time) {
+	sessid := rec.field("session")
+	clientid := rec.field("client_id")
+	names := a.kernelNames.labelValues(rec.field("name"))
+	runtime := rec.number("running_time")
+	callcount := rec.number("call_count")
+	blocknum := rec.number("block_num")
+	threadnum := rec.number("thread_num")
+	if a.logParsed {
 		log.Printf("data parsed: SESS: %s CLIENT_ID: %s KERNEL_NAME: %s RUNTIME: %d CALLCOUNT: %d BLOCK_NUM: %d THREAD_NUM: %d",
-			sessid, clientid, kernelname, runtime, callcount, blocknum, threadnum)
+			sessid, clientid, names[0], runtime, callcount, blocknum, threadnum)
 		return
 	}
-	labels := prometheus.Labels{
-		"session":   sessid,
-		"client_id": clientid,
-		"name":      kernelname,
+	lvs := append([]string{sessid, clientid}, names...)
+
+	a.push(a.kernelRuntimeMetric, lvs, runtime, ts)
+	a.push(a.kernelCallcountMetric, lvs, callcount, ts)
+	a.push(a.kernelBlocknumMetric, lvs, blocknum, ts)
+	a.push(a.kernelThreadnumMetric, lvs, threadnum, ts)
+	a.derived.pushKernel(lvs, runtime, callcount, blocknum, threadnum, ts)
+	if a.kernelLatency != nil {
+		a.kernelLatency.observe(lvs, runtime, callcount)
 	}
+}
 
-	kernelRuntimeMetric.With(labels).Set(float64(runtime))
-	kernelCallcountMetric.With(labels).Set(float64(callcount))
-	kernelBlocknumMetric.With(labels).Set(float64(blocknum))
-	kernelThreadnumMetric.With(labels).Set(float64(threadnum))
+func (a *asaka) push(m *metric, lvs []string, v uint64, ts time.Time) {
+	if err := m.setAt(lvs, float64(v), ts); err != nil {
+		log.Println(err)
+	}
 }
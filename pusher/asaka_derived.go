@@ -0,0 +1,122 @@
+package pusher
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/olebedev/config"
+)
+
+const (
+	defaultMemcpyAPIs      = "(?i)memcpy"
+	defaultRunningTimeUnit = time.Microsecond
+)
+
+// asakaDerived computes metrics derived from the values of an asaka line,
+// each enabled by its name in the "derived" map:
+//
+//	derived:
+//	  asaka_api_running_time_per_call: true
+//	  asaka_kernel_running_time_per_call: true
+//	  asaka_kernel_threads_per_block: true
+//	  asaka_api_memcpy_bandwidth_bytes_per_second: true
+//	memcpyapis:       regular expression of transfer API names, default (?i)memcpy
+//	runningtimeunit:  duration of a running time unit, default 1us
+//
+// Series with a zero divisor are not updated.
+type asakaDerived struct {
+	apiRuntimePerCall     *metric
+	kernelRuntimePerCall  *metric
+	kernelThreadsPerBlock *metric
+	memcpyBandwidth       *metric
+
+	memcpyAPIs      *regexp.Regexp
+	runningTimeUnit time.Duration
+}
+
+func newAsakaDerived(cfg *config.Config, kernelLabels []string) (*asakaDerived, error) {
+	d := &asakaDerived{}
+	enabled := cfg.UMap("derived")
+	declared := map[string]bool{}
+	for _, m := range []struct {
+		m          **metric
+		spec       metricSpec
+		labelNames []string
+	}{
+		{&d.apiRuntimePerCall, metricSpec{name: "asaka_api_running_time_per_call", help: "api average running time per call"}, apiLabelList},
+		{&d.kernelRuntimePerCall, metricSpec{name: "asaka_kernel_running_time_per_call", help: "kernel average running time per call"}, kernelLabels},
+		{&d.kernelThreadsPerBlock, metricSpec{name: "asaka_kernel_threads_per_block", help: "kernel threads per block"}, kernelLabels},
+		{&d.memcpyBandwidth, metricSpec{name: "asaka_api_memcpy_bandwidth", unit: "bytes_per_second", help: "effective bandwidth of transfer apis"}, apiLabelList},
+	} {
+		name := m.spec.fqName()
+		declared[name] = true
+		on, _ := enabled[name].(bool)
+		if on {
+			m.spec.typ = metricTypeGauge
+			*m.m = newMetric(m.spec, m.labelNames)
+		}
+	}
+	for name := range enabled {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown asaka derived metric %s", name)
+		}
+	}
+	var err error
+	if d.memcpyAPIs, err = regexp.Compile(cfg.UString("memcpyapis", defaultMemcpyAPIs)); err != nil {
+		return nil, fmt.Errorf("invalid memcpyapis, %v", err)
+	}
+	if d.runningTimeUnit, err = runningTimeUnit(cfg); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// runningTimeUnit is the duration of a unit of asaka running times
+func runningTimeUnit(cfg *config.Config) (time.Duration, error) {
+	unit, err := time.ParseDuration(cfg.UString("runningtimeunit", defaultRunningTimeUnit.String()))
+	if err != nil {
+		return 0, fmt.Errorf("invalid runningtimeunit, %v", err)
+	}
+	if unit <= 0 {
+		return 0, fmt.Errorf("runningtimeunit must be positive")
+	}
+	return unit, nil
+}
+
+// metrics returns the enabled metrics
+func (d *asakaDerived) metrics() []*metric {
+	var ms []*metric
+	for _, m := range []*metric{d.apiRuntimePerCall, d.kernelRuntimePerCall, d.kernelThreadsPerBlock, d.memcpyBandwidth} {
+		if m != nil {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+func (d *asakaDerived) pushAPI(lvs []string, apiname string, runtime, callcount, size uint64, ts time.Time) {
+	if d.apiRuntimePerCall != nil && callcount > 0 {
+		d.set(d.apiRuntimePerCall, lvs, float64(runtime)/float64(callcount), ts)
+	}
+	if d.memcpyBandwidth != nil && runtime > 0 && d.memcpyAPIs.MatchString(apiname) {
+		seconds := float64(runtime) * d.runningTimeUnit.Seconds()
+		d.set(d.memcpyBandwidth, lvs, float64(size)/seconds, ts)
+	}
+}
+
+func (d *asakaDerived) pushKernel(lvs []string, runtime, callcount, blocknum, threadnum uint64, ts time.Time) {
+	if d.kernelRuntimePerCall != nil && callcount > 0 {
+		d.set(d.kernelRuntimePerCall, lvs, float64(runtime)/float64(callcount), ts)
+	}
+	if d.kernelThreadsPerBlock != nil && blocknum > 0 {
+		d.set(d.kernelThreadsPerBlock, lvs, float64(threadnum)/float64(blocknum), ts)
+	}
+}
+
+func (d *asakaDerived) set(m *metric, lvs []string, v float64, ts time.Time) {
+	if err := m.setAt(lvs, v, ts); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,143 @@
+package pusher
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// asakaLatency derives the duration per call of an interval from two
+// successive cumulative lines of a series and observes it by a histogram
+// and optionally a summary, configured per record type:
+//
+//	latency:
+//	  kernel:
+//	    buckets: [0.00001, 0.0001, 0.001, 0.01, 0.1]
+//	    quantiles:
+//	      "0.5": 0.05
+//	      "0.99": 0.001
+//	  api:
+//	    buckets: [0.00001, 0.0001, 0.001]
+//
+// Durations are in seconds, converted from running times by runningtimeunit.
+// Buckets must be finite and strictly increasing, quantiles in (0, 1) with
+// errors in [0, 1). Buckets default to the Prometheus default buckets, the
+// summary is only exposed with quantiles. A decreasing running time or call
+// count is taken as reset and the values of the line are used as interval.
+// The series are expired and limited like the other metrics of the pipeline.
+type asakaLatency struct {
+	histogram *metric
+	summary   *metric
+	unit      time.Duration
+}
+
+// newAsakaLatency returns nil if the latency of the record type recType isn't
+// configured
+func newAsakaLatency(cfg *config.Config, recType string, labelNames []string) (*asakaLatency, error) {
+	decl, err := cfg.Map("latency." + recType)
+	if err != nil {
+		return nil, nil
+	}
+	l := &asakaLatency{}
+	if l.unit, err = runningTimeUnit(cfg); err != nil {
+		return nil, err
+	}
+	buckets := prometheus.DefBuckets
+	if list, ok := decl["buckets"].([]interface{}); ok {
+		buckets = nil
+		for _, v := range list {
+			b, err := numberValue(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s latency bucket: %v", recType, err)
+			}
+			if math.IsInf(b, 0) || math.IsNaN(b) {
+				return nil, fmt.Errorf("%s latency bucket %v must be finite", recType, b)
+			}
+			if n := len(buckets); n > 0 && b <= buckets[n-1] {
+				return nil, fmt.Errorf("%s latency buckets must be strictly increasing", recType)
+			}
+			buckets = append(buckets, b)
+		}
+	}
+	spec := metricSpec{
+		name: "asaka_" + recType + "_call_duration_seconds",
+		help: recType + " duration per call",
+		typ:  metricTypeHistogram,
+	}
+	histogram := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    spec.name,
+			Help:    spec.help,
+			Buckets: buckets,
+		},
+		labelNames,
+	)
+	l.histogram = newObserverMetric(spec, labelNames, histogram.MetricVec)
+	quantiles, _ := decl["quantiles"].(map[string]interface{})
+	if len(quantiles) > 0 {
+		objectives := map[float64]float64{}
+		for q, e := range quantiles {
+			quantile, err := strconv.ParseFloat(q, 64)
+			if err != nil || !(quantile > 0 && quantile < 1) {
+				return nil, fmt.Errorf("invalid %s latency quantile %q", recType, q)
+			}
+			if objectives[quantile], err = numberValue(e); err != nil {
+				return nil, fmt.Errorf("%s latency quantile %s: %v", recType, q, err)
+			}
+			if e := objectives[quantile]; !(e >= 0 && e < 1) {
+				return nil, fmt.Errorf("%s latency quantile %s: error %v must be in [0, 1)", recType, q, e)
+			}
+		}
+		spec := metricSpec{
+			name: "asaka_" + recType + "_call_duration_summary_seconds",
+			help: recType + " duration per call",
+			typ:  metricTypeSummary,
+		}
+		summary := prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       spec.name,
+				Help:       spec.help,
+				Objectives: objectives,
+			},
+			labelNames,
+		)
+		l.summary = newObserverMetric(spec, labelNames, summary.MetricVec)
+	}
+	return l, nil
+}
+
+// metrics returns the histogram and the summary if configured
+func (l *asakaLatency) metrics() []*metric {
+	ms := []*metric{l.histogram}
+	if l.summary != nil {
+		ms = append(ms, l.summary)
+	}
+	return ms
+}
+
+// observe records the cumulative values of a line, the duration per call
+// since the last line of the series is observed
+func (l *asakaLatency) observe(lvs []string, runtime, calls uint64) {
+	raw := []float64{float64(runtime), float64(calls)}
+	for _, m := range l.metrics() {
+		m.observe(lvs, raw, l.durationPerCall)
+	}
+}
+
+// durationPerCall derives the duration per call of the interval between the
+// last and the current line
+func (l *asakaLatency) durationPerCall(last, raw []float64) (float64, bool) {
+	runtime, calls := raw[0], raw[1]
+	if runtime >= last[0] && calls >= last[1] {
+		runtime -= last[0]
+		calls -= last[1]
+	}
+	if calls == 0 {
+		return 0, false
+	}
+	return runtime / calls * l.unit.Seconds(), true
+}
@@ -0,0 +1,105 @@
+package pusher
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type asakaFieldKind int
+
+const (
+	// asakaText is any value
+	asakaText asakaFieldKind = iota
+	// asakaName is a non-empty value
+	asakaName
+	// asakaUint is an unsigned decimal number
+	asakaUint
+	// asakaAddress is a hexadecimal address prefixed with 0x
+	asakaAddress
+)
+
+type asakaField struct {
+	name string
+	kind asakaFieldKind
+}
+
+// asakaSchema declares the fields of an asaka record type, fields following
+// the declared ones are ignored so that newer asaka versions can append
+// fields to a record
+type asakaSchema []asakaField
+
+var asakaSchemas = map[AsakaLogType]asakaSchema{
+	MONITOR_API: {
+		{"timestamp", asakaText},
+		{"type", asakaText},
+		{"session", asakaText},
+		{"client_id", asakaText},
+		{"api", asakaName},
+		{"running_time", asakaUint},
+		{"call_count", asakaUint},
+		{"total_size", asakaUint},
+	},
+	MONITOR_KERNEL: {
+		{"timestamp", asakaText},
+		{"type", asakaText},
+		{"session", asakaText},
+		{"client_id", asakaText},
+		{"address", asakaAddress},
+		{"name", asakaName},
+		{"running_time", asakaUint},
+		{"call_count", asakaUint},
+		{"block_num", asakaUint},
+		{"thread_num", asakaUint},
+	},
+}
+
+// asakaRecord is an asaka line validated by its schema
+type asakaRecord struct {
+	fields  map[string]string
+	numbers map[string]uint64
+}
+
+func (r *asakaRecord) field(name string) string {
+	return r.fields[name]
+}
+
+func (r *asakaRecord) number(name string) uint64 {
+	return r.numbers[name]
+}
+
+// validate checks the fields of a line against the schema, the reason of a
+// rejected line is returned with the error
+func (s asakaSchema) validate(dataList []string) (*asakaRecord, string, error) {
+	if len(dataList) < len(s) {
+		return nil, reasonMissingFields, fmt.Errorf("%d fields, expected %d", len(dataList), len(s))
+	}
+	r := &asakaRecord{
+		fields:  make(map[string]string, len(s)),
+		numbers: map[string]uint64{},
+	}
+	for i, f := range s {
+		v := dataList[i]
+		switch f.kind {
+		case asakaName:
+			if len(v) == 0 {
+				return nil, reasonEmptyField, fmt.Errorf("%s is empty", f.name)
+			}
+		case asakaUint:
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, reasonInvalidNumber, fmt.Errorf("%s: %v", f.name, err)
+			}
+			r.numbers[f.name] = n
+		case asakaAddress:
+			if !strings.HasPrefix(v, "0x") {
+				return nil, reasonInvalidAddress, fmt.Errorf("%s %q is not prefixed with 0x", f.name, v)
+			}
+			if _, err := strconv.ParseUint(v[2:], 16, 64); err != nil {
+				return nil, reasonInvalidAddress, fmt.Errorf("%s: %v", f.name, err)
+			}
+		}
+		r.fields[f.name] = v
+	}
+	return r, "", nil
+}
@@ -1,8 +1,12 @@
 package pusher
 
 import (
+	"context"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/ksang/hana/lifecycle"
 )
 
 var (
@@ -31,18 +35,292 @@ func TestAsakaPusher(t *testing.T) {
 		return
 	}
 	src := make(chan string, 1)
-	err = pusher.Start(src)
+	err = pusher.Start(context.Background(), src)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	if err := pusher.Start(context.Background(), src); err != lifecycle.ErrStarted {
+		t.Errorf("actual: %v, expected: %v", err, lifecycle.ErrStarted)
+	}
 
 	go func() {
 		for _, data := range asaka_monitor_data {
-			time.Sleep(200 * time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
 			src <- data
 		}
+		close(src)
 	}()
-	time.Sleep(5 * time.Second)
-	pusher.Stop()
+	select {
+	case <-pusher.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("pusher didn't end after the datasource channel was closed")
+	}
+	for i := 0; i < 2; i++ {
+		if err := pusher.Stop(); err != nil {
+			t.Errorf("Stop #%d, actual: %v, expected: nil", i+1, err)
+		}
+	}
+}
+
+func TestAsakaAccumulation(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\n" +
+		"accumulation:\n  asaka_api_call_count: cumulative\n  asaka_api_total_size: delta\n"
+	p, err := NewAsaka(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		"1502970051,1,0,2,cuda_init,7,5,10",
+		"1502970052,1,0,2,cuda_init,9,8,20",
+		"1502970053,1,0,2,cuda_init,2,2,5",
+		"1502970054,1,0,2,cuda_init,3,4,5",
+	} {
+		p.(*asaka).ParseAndPush(data)
+	}
+
+	cases := []struct {
+		metric   string
+		expected float64
+	}{
+		{"asaka_api_running_time", 3},
+		{"asaka_api_call_count", 12},
+		{"asaka_api_total_size", 40},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, map[string]string{"api": "cuda_init"})
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+
+	if _, err := NewAsaka("accumulation:\n  asaka_api_call_count: sum\n"); err == nil {
+		t.Error("expected error for unknown accumulation")
+	}
+	if _, err := NewAsaka("accumulation:\n  unknown_metric: delta\n"); err == nil {
+		t.Error("expected error for unknown metric")
+	}
+}
+
+func TestAsakaDemangle(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\ndemangle: true\ndemanglelabels: true\n"
+	p, err := NewAsaka(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range asaka_monitor_data {
+		p.(*asaka).ParseAndPush(data)
+	}
+	p.(*asaka).ParseAndPush("1504171516,2,0,1,0x7fb7ec06b9a0,_Zbroken,5,1,1,1")
+
+	cases := []struct {
+		labels   map[string]string
+		expected float64
+	}{
+		{map[string]string{"name": "IFFT512_device<double2, double>(double2*)"}, 97},
+		{map[string]string{"name": "chk512_device<float2>(float2 const*, int, char*)", "kernel_base": "chk512_device"}, 104},
+		{map[string]string{"name": "_Zbroken", "kernel_base": "_Zbroken", "kernel_namespace": ""}, 5},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, "asaka_kernel_running_time", c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+}
+
+func TestAsakaParseErrors(t *testing.T) {
+	p, err := NewAsaka("pushurl: http://127.0.0.1:9091\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		data   string
+		reason string
+	}{
+		{"1502970051", reasonShortLine},
+		{"1502970051,x,0,2,cuda_init,2,1,0", reasonInvalidType},
+		{"1502970051,9,0,2,cuda_init,2,1,0", reasonUnknownType},
+		{"1502970051,1,0,2,cuda_init,2,1", reasonMissingFields},
+		{"1504171516,2,0,1,0x7fb7ec062910,_Z13FFT512_deviceI6float2fEvPT_,130,10,25x,640", reasonInvalidNumber},
+		{"1502970051,1,0,2,,2,1,0", reasonEmptyField},
+		{"1504171516,2,0,1,7fb7ec062910,kernel,130,10,2560,640", reasonInvalidAddress},
+		{"yesterday,1,0,2,cuda_init,2,1,0", reasonInvalidTimestamp},
+	}
+	for idx, c := range cases {
+		p.(*asaka).ParseAndPush(c.data)
+		res, ok := gatheredValue(t, p, "hana_parse_errors_total", map[string]string{"reason": c.reason})
+		if !ok || res != 1 {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, 1)
+		}
+	}
+
+	// newer asaka versions may append fields
+	p.(*asaka).ParseAndPush("1502970051,1,0,2,cuda_init,2,1,0,7,extra")
+	if res, ok := gatheredValue(t, p, "asaka_api_running_time", map[string]string{"api": "cuda_init"}); !ok || res != 2 {
+		t.Errorf("actual: %v, expected: %v", res, 2)
+	}
+}
+
+func FuzzAsakaParseAndPush(f *testing.F) {
+	for _, data := range asaka_monitor_data {
+		f.Add(data)
+	}
+	f.Add("1504171516,2,0,1")
+	f.Add(",,,,,,,,,,")
+	p, err := NewAsaka("pushurl: http://127.0.0.1:9091\ndemangle: true\ndemanglelabels: true\n")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		p.(*asaka).ParseAndPush(data)
+	})
+}
+
+func TestAsakaDerived(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\n" +
+		"derived:\n" +
+		"  asaka_api_running_time_per_call: true\n" +
+		"  asaka_kernel_running_time_per_call: true\n" +
+		"  asaka_kernel_threads_per_block: true\n" +
+		"  asaka_api_memcpy_bandwidth_bytes_per_second: true\n"
+	p, err := NewAsaka(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range asaka_monitor_data {
+		p.(*asaka).ParseAndPush(data)
+	}
+	p.(*asaka).ParseAndPush("1504171516,1,0,1,cuMemcpyHtoD,500,2,1000000")
+
+	cases := []struct {
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{"asaka_api_running_time_per_call", map[string]string{"api": "TEST"}, 983.0 / 4},
+		{"asaka_kernel_running_time_per_call", map[string]string{"name": "_Z13FFT512_deviceI6float2fEvPT_"}, 13},
+		{"asaka_kernel_threads_per_block", map[string]string{"name": "_Z13chk512_deviceI7double2EvPKT_iPc"}, 0.1},
+		{"asaka_api_memcpy_bandwidth_bytes_per_second", map[string]string{"api": "cuMemcpyHtoD"}, 2e9},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+	if _, ok := gatheredValue(t, p, "asaka_api_memcpy_bandwidth_bytes_per_second", map[string]string{"api": "TEST"}); ok {
+		t.Errorf("bandwidth of non transfer api exposed")
+	}
+
+	if _, err := NewAsaka("derived:\n  asaka_unknown: true\n"); err == nil {
+		t.Errorf("unknown derived metric accepted")
+	}
+}
+
+func TestAsakaLatency(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\n" +
+		"latency:\n" +
+		"  kernel:\n" +
+		"    buckets: [0.000005, 0.00001, 0.0001]\n" +
+		"    quantiles:\n" +
+		"      \"0.5\": 0.05\n"
+	p, err := NewAsaka(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		"1504171516,2,0,1,0x7fb7ec062910,kernel,100,10,2560,640",
+		"1504171517,2,0,1,0x7fb7ec062910,kernel,160,20,2560,640",
+		"1504171518,2,0,1,0x7fb7ec062910,kernel,160,20,2560,640",
+		"1504171519,2,0,1,0x7fb7ec062910,kernel,500,10,2560,640",
+	} {
+		p.(*asaka).ParseAndPush(data)
+	}
+	mfs, err := p.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// intervals of 6us per call and 50us per call after the reset
+	found := map[string]bool{}
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "asaka_kernel_call_duration_seconds":
+			h := mf.Metric[0].Histogram
+			if h.GetSampleCount() != 2 || h.Bucket[0].GetCumulativeCount() != 0 ||
+				h.Bucket[1].GetCumulativeCount() != 1 || h.Bucket[2].GetCumulativeCount() != 2 {
+				t.Errorf("actual histogram: %v", h)
+			}
+		case "asaka_kernel_call_duration_summary_seconds":
+			if s := mf.Metric[0].Summary; s.GetSampleCount() != 2 || len(s.Quantile) != 1 {
+				t.Errorf("actual summary: %v", s)
+			}
+		case "asaka_api_call_duration_seconds":
+			t.Errorf("api latency exposed without config")
+		default:
+			continue
+		}
+		found[mf.GetName()] = true
+	}
+	if len(found) != 2 {
+		t.Errorf("actual: %v, expected histogram and summary", found)
+	}
+
+}
+
+func TestAsakaLatencyInvalid(t *testing.T) {
+	cases := []struct {
+		conf string
+		err  string
+	}{
+		{"latency:\n  api:\n    buckets: [2, 1]\n", "strictly increasing"},
+		{"latency:\n  api:\n    buckets: [0.001, 0.001]\n", "strictly increasing"},
+		{"latency:\n  api:\n    buckets: [0.001, .inf]\n", "must be finite"},
+		{"latency:\n  api:\n    quantiles:\n      \"1\": 0.01\n", `invalid api latency quantile "1"`},
+		{"latency:\n  api:\n    quantiles:\n      \"0.5\": 1\n", "must be in [0, 1)"},
+		{"latency:\n  api:\n    quantiles:\n      \"0.5\": -0.1\n", "must be in [0, 1)"},
+	}
+	for idx, c := range cases {
+		_, err := NewAsaka(c.conf)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, c.err)
+		}
+	}
+}
+
+func TestAsakaLatencyLimits(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\nttl: 1m\n" +
+		"metricmaxseries:\n  asaka_kernel_call_duration_seconds: 1\n" +
+		"latency:\n  kernel:\n    buckets: [0.001]\n"
+	p, err := NewAsaka(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.(*asaka)
+	for _, data := range []string{
+		"1504171516,2,0,1,0x7fb7ec062910,a,100,10,2560,640",
+		"1504171517,2,0,1,0x7fb7ec062910,a,160,20,2560,640",
+		"1504171516,2,0,1,0x7fb7ec062910,b,100,10,2560,640",
+		"1504171517,2,0,1,0x7fb7ec062910,b,160,20,2560,640",
+	} {
+		a.ParseAndPush(data)
+	}
+	histogram := a.kernelLatency.histogram
+	rejected, _ := gatheredValue(t, p, "hana_rejected_series_total", map[string]string{"metric": histogram.spec.fqName()})
+	if len(histogram.series) != 1 || rejected != 2 {
+		t.Errorf("actual: %d series %v rejected, expected: 1 series 2 rejected", len(histogram.series), rejected)
+	}
+
+	// the last values expire with the series
+	a.expire(time.Now().Add(2 * time.Minute))
+	if len(histogram.series) != 0 {
+		t.Errorf("actual: %d series, expected: 0", len(histogram.series))
+	}
+	expired, _ := gatheredValue(t, p, "hana_expired_series_total", map[string]string{"metric": histogram.spec.fqName()})
+	if expired != 1 {
+		t.Errorf("actual expired series: %v, expected: 1", expired)
+	}
+	if _, err := NewAsaka("metricttl:\n  asaka_api_call_duration_seconds: 1m\n"); err == nil {
+		t.Errorf("metricttl of unconfigured latency accepted")
+	}
 }
@@ -0,0 +1,453 @@
+package pusher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ksang/hana/alerting"
+	"github.com/ksang/hana/lifecycle"
+	"github.com/ksang/hana/rules"
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons of lines rejected by the parser
+const (
+	reasonShortLine        = "short_line"
+	reasonInvalidType      = "invalid_type"
+	reasonUnknownType      = "unknown_type"
+	reasonMissingFields    = "missing_fields"
+	reasonEmptyField       = "empty_field"
+	reasonInvalidNumber    = "invalid_number"
+	reasonInvalidAddress   = "invalid_address"
+	reasonInvalidTimestamp = "invalid_timestamp"
+	reasonUnmatched        = "unmatched"
+)
+
+// defaultRuleInterval is the default interval of recording rule evaluation
+const defaultRuleInterval = 15 * time.Second
+
+// defaultAlertInterval is the default interval of alert evaluation
+const defaultAlertInterval = 15 * time.Second
+
+// minExpireInterval bounds how often series are checked for expiry
+const minExpireInterval = time.Second
+
+// base implements the lifecycle shared by all pushers: consuming lines from
+// the datasource channel, owning the pipeline registry, pushing to gateway
+// and expiring stale series:
+//
+//	logparsed:  log parsed lines instead of setting metrics, default true
+//	            without pushurl
+//
+//	ttl:        remove series without samples for ttl, default 0 (never)
+//	metricttl:  map of metric name to ttl, overriding ttl, names must be
+//	            registered metrics
+//	endedinfo:  expose <metric>_ended_timestamp_seconds for expired series
+//
+// and limiting the number of series per metric:
+//
+//	maxseries:        series limit of every metric, default 0 (unlimited)
+//	metricmaxseries:  map of metric name to series limit, overriding maxseries,
+//	                  names must be registered metrics
+//	overflow:         "bucket" (default) samples of new series beyond the limit
+//	                  into the series with all labels "__overflow__", or "drop" them
+//
+// Samples of cumulative counters and of histograms and summaries derived from
+// cumulative values beyond the limit are always dropped, as their increase
+// can't be told without the last values of their series.
+//
+// Rejected lines are counted by hana_parse_errors_total and can be kept in a
+// dead-letter file, see deadLetter. Recording rules are evaluated over the
+// pipeline registry:
+//
+//	rulefiles:     list of rule files in the shape of Prometheus rule files
+//	ruleinterval:  interval of rule evaluation, default 15s
+//
+// and alert rules, see package alerting:
+//
+//	alertfiles:     list of alert rule files
+//	alertinterval:  interval of alert evaluation, default 15s
+//	alertwebhooks:  list of webhook urls notified of firing and resolved alerts
+//	alertmanagers:  list of Alertmanager base urls
+type base struct {
+	pushUrl   string
+	logParsed bool
+	runner    *lifecycle.Runner
+	gateway   *gateway
+	registry  *prometheus.Registry
+	gatherer  prometheus.Gatherer
+	parse     func(string)
+
+	ttl           time.Duration
+	metricTTL     map[string]time.Duration
+	endedInfo     bool
+	metrics       []*metric
+	expiredMetric *prometheus.CounterVec
+
+	maxSeries       int
+	metricMaxSeries map[string]int
+	overflowDrop    bool
+	rejectedMetric  *prometheus.CounterVec
+
+	parseErrorsMetric *prometheus.CounterVec
+	deadLetter        *deadLetter
+	// lineErr is the last error of the line parsed by ParseLine
+	lineErr error
+
+	// housekeeping is called every housekeepingInterval by the goroutine
+	// consuming lines, if set by the pusher
+	housekeeping         func(now time.Time)
+	housekeepingInterval time.Duration
+
+	rules        *rules.Evaluator
+	ruleInterval time.Duration
+
+	alerts        *alerting.Manager
+	alertInterval time.Duration
+}
+
+// newBase creates the lifecycle of a pusher, parse is called for every line
+// read from the datasource
+func newBase(cfg *config.Config, parse func(string)) (*base, error) {
+	pushurl, err := cfg.String("pushurl")
+	if err != nil {
+		pushurl = ""
+	}
+	b := &base{
+		pushUrl:   pushurl,
+		logParsed: cfg.UBool("logparsed", len(pushurl) == 0),
+		runner:    lifecycle.NewRunner(),
+		registry:  prometheus.NewRegistry(),
+		parse:     parse,
+		metricTTL: map[string]time.Duration{},
+		endedInfo: cfg.UBool("endedinfo", false),
+		expiredMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_expired_series_total",
+				Help: "series removed after receiving no sample for their ttl",
+			},
+			[]string{"metric"},
+		),
+		maxSeries:       cfg.UInt("maxseries", 0),
+		metricMaxSeries: map[string]int{},
+		rejectedMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_rejected_series_total",
+				Help: "samples of new series rejected by the series limit",
+			},
+			[]string{"metric"},
+		),
+		parseErrorsMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_parse_errors_total",
+				Help: "lines rejected by the parser",
+			},
+			[]string{"reason"},
+		),
+	}
+	switch overflow := cfg.UString("overflow", "bucket"); overflow {
+	case "bucket":
+	case "drop":
+		b.overflowDrop = true
+	default:
+		return nil, fmt.Errorf("unknown overflow %q", overflow)
+	}
+	for name, v := range cfg.UMap("metricmaxseries") {
+		if b.metricMaxSeries[name], err = intValue(v); err != nil {
+			return nil, fmt.Errorf("invalid series limit of metric %s, %v", name, err)
+		}
+	}
+	if b.ttl, err = time.ParseDuration(cfg.UString("ttl", "0s")); err != nil {
+		return nil, fmt.Errorf("invalid ttl, %v", err)
+	}
+	for name, v := range cfg.UMap("metricttl") {
+		if b.metricTTL[name], err = time.ParseDuration(stringValue(v)); err != nil {
+			return nil, fmt.Errorf("invalid ttl of metric %s, %v", name, err)
+		}
+	}
+	b.registry.MustRegister(b.expiredMetric)
+	b.registry.MustRegister(b.rejectedMetric)
+	b.registry.MustRegister(b.parseErrorsMetric)
+	b.gatherer = newPipelineGatherer(cfg, b.registry)
+	if len(pushurl) > 0 {
+		b.gateway, err = newGateway(cfg, b.gatherer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := b.loadRules(cfg); err != nil {
+		return nil, err
+	}
+	if err := b.loadAlerts(cfg); err != nil {
+		return nil, err
+	}
+	if b.deadLetter, err = newDeadLetter(cfg); err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file, %v", err)
+	}
+	return b, nil
+}
+
+// loadRules creates the evaluator of the configured rule files
+func (b *base) loadRules(cfg *config.Config) error {
+	var paths []string
+	for _, v := range cfg.UList("rulefiles") {
+		paths = append(paths, stringValue(v))
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	interval, err := time.ParseDuration(cfg.UString("ruleinterval", defaultRuleInterval.String()))
+	if err != nil {
+		return fmt.Errorf("invalid ruleinterval, %v", err)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("ruleinterval must be positive")
+	}
+	groups, err := rules.Load(paths...)
+	if err != nil {
+		return err
+	}
+	b.rules = rules.NewEvaluator(groups, b.registry)
+	b.ruleInterval = interval
+	return b.registry.Register(b.rules)
+}
+
+// loadAlerts creates the manager of the configured alert files
+func (b *base) loadAlerts(cfg *config.Config) error {
+	var paths []string
+	for _, v := range cfg.UList("alertfiles") {
+		paths = append(paths, stringValue(v))
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	interval, err := time.ParseDuration(cfg.UString("alertinterval", defaultAlertInterval.String()))
+	if err != nil {
+		return fmt.Errorf("invalid alertinterval, %v", err)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("alertinterval must be positive")
+	}
+	rs, err := alerting.Load(paths...)
+	if err != nil {
+		return err
+	}
+	var notifiers []alerting.Notifier
+	for _, v := range cfg.UList("alertwebhooks") {
+		notifiers = append(notifiers, &alerting.Webhook{URL: stringValue(v)})
+	}
+	for _, v := range cfg.UList("alertmanagers") {
+		notifiers = append(notifiers, &alerting.Alertmanager{URL: stringValue(v), EndsAfter: 4 * interval})
+	}
+	b.alerts = alerting.NewManager(rs, b.gatherer, notifiers...)
+	b.alertInterval = interval
+	return b.registry.Register(b.alerts)
+}
+
+// registerMetrics registers metrics to the pipeline registry and applies
+// the configured ttl and series limit, it fails if a metric collides with a
+// registered one
+func (b *base) registerMetrics(ms ...*metric) error {
+	for _, m := range ms {
+		name := m.spec.fqName()
+		ttl, ok := b.metricTTL[name]
+		if !ok {
+			ttl = b.ttl
+		}
+		m.setTTL(ttl, b.endedInfo)
+		maxSeries, ok := b.metricMaxSeries[name]
+		if !ok {
+			maxSeries = b.maxSeries
+		}
+		m.setLimit(maxSeries, b.overflowDrop, b.rejectedMetric.WithLabelValues(name))
+		if err := b.registry.Register(m.collector()); err != nil {
+			return fmt.Errorf("metric %s: %v", name, err)
+		}
+		b.metrics = append(b.metrics, m)
+	}
+	return nil
+}
+
+// checkMetricNames rejects metricttl and metricmaxseries keys which don't
+// name a registered metric, it is called after the pusher registered all its
+// metrics
+func (b *base) checkMetricNames() error {
+	names := map[string]bool{}
+	for _, m := range b.metrics {
+		names[m.spec.fqName()] = true
+	}
+	for name := range b.metricTTL {
+		if !names[name] {
+			return fmt.Errorf("metricttl of unknown metric %s", name)
+		}
+	}
+	for name := range b.metricMaxSeries {
+		if !names[name] {
+			return fmt.Errorf("metricmaxseries of unknown metric %s", name)
+		}
+	}
+	return nil
+}
+
+// expireInterval is half of the shortest ttl, 0 if no metric expires
+func (b *base) expireInterval() time.Duration {
+	var interval time.Duration
+	for _, m := range b.metrics {
+		if m.ttl > 0 && (interval == 0 || m.ttl/2 < interval) {
+			interval = m.ttl / 2
+		}
+	}
+	if interval > 0 && interval < minExpireInterval {
+		interval = minExpireInterval
+	}
+	return interval
+}
+
+// expire removes stale series of all metrics
+func (b *base) expire(now time.Time) {
+	for _, m := range b.metrics {
+		if n := m.expire(now); n > 0 {
+			b.expiredMetric.WithLabelValues(m.spec.fqName()).Add(float64(n))
+		}
+	}
+}
+
+// parseError counts a line rejected by the parser for reason, logs it and
+// writes it to the dead-letter file
+func (b *base) parseError(line, reason string, err error) {
+	b.countParseError(reason, err)
+	log.Printf("failed to parse line, %s: %v, %q", reason, err, line)
+	if b.deadLetter != nil {
+		if err := b.deadLetter.write(line, reason, err); err != nil {
+			log.Println("failed to write dead-letter file,", err)
+		}
+	}
+}
+
+// countParseError counts a line rejected by the parser for reason without
+// logging or dead-lettering it
+func (b *base) countParseError(reason string, err error) {
+	b.parseErrorsMetric.WithLabelValues(reason).Inc()
+	b.lineError(fmt.Errorf("%s: %v", reason, err))
+}
+
+// lineError records err as error of the line parsed by ParseLine
+func (b *base) lineError(err error) {
+	if b.lineErr == nil {
+		b.lineErr = err
+	}
+}
+
+// ParseLine parses a line synchronously and returns its first error, it must
+// not be called after Start
+func (b *base) ParseLine(line string) error {
+	b.lineErr = nil
+	b.parse(line)
+	return b.lineErr
+}
+
+// Start parses the lines of src in a goroutine, rules, alerts and pushes run
+// alongside and the final push is performed when it ends
+func (b *base) Start(ctx context.Context, src <-chan string) error {
+	if b.deadLetter != nil {
+		if err := b.deadLetter.start(); err != nil {
+			return err
+		}
+	}
+	return b.runner.Start(ctx, func(ctx context.Context) error {
+		if b.gateway != nil {
+			b.gateway.start()
+		}
+		if b.rules != nil {
+			b.rules.Start(b.ruleInterval)
+		}
+		if b.alerts != nil {
+			b.alerts.Start(b.alertInterval)
+		}
+		b.consume(ctx, src)
+		if b.rules != nil {
+			b.rules.Stop()
+		}
+		if b.alerts != nil {
+			b.alerts.Stop()
+		}
+		if b.deadLetter != nil {
+			b.deadLetter.close()
+		}
+		if b.gateway != nil {
+			return b.gateway.stop()
+		}
+		return nil
+	})
+}
+
+// consume parses the lines of src until ctx is done or src is closed, stale
+// series are expired and housekeeping is done meanwhile
+func (b *base) consume(ctx context.Context, src <-chan string) {
+	var expireCh, housekeepingCh <-chan time.Time
+	if interval := b.expireInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		expireCh = ticker.C
+	}
+	if b.housekeeping != nil {
+		ticker := time.NewTicker(b.housekeepingInterval)
+		defer ticker.Stop()
+		housekeepingCh = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-expireCh:
+			b.expire(now)
+		case now := <-housekeepingCh:
+			b.housekeeping(now)
+		case line, ok := <-src:
+			if !ok {
+				return
+			}
+			b.parse(line)
+		}
+	}
+}
+
+// PushGroupURL returns the url of the Pushgateway group, empty without pushurl
+func (b *base) PushGroupURL() string {
+	if b.gateway == nil {
+		return ""
+	}
+	return b.gateway.url
+}
+
+// KeepPushGroup makes Stop skip deleting the Pushgateway group
+func (b *base) KeepPushGroup() {
+	if b.gateway != nil {
+		b.gateway.keep()
+	}
+}
+
+// Stop ends the pusher and waits for its final push, the dead-letter file
+// is closed even if the pusher was never started
+func (b *base) Stop() error {
+	err := b.runner.Stop()
+	if b.deadLetter != nil {
+		b.deadLetter.close()
+	}
+	return err
+}
+
+func (b *base) Done() <-chan struct{} {
+	return b.runner.Done()
+}
+
+func (b *base) Errors() <-chan error {
+	return b.runner.Errors()
+}
+
+func (b *base) Gatherer() prometheus.Gatherer {
+	return b.gatherer
+}
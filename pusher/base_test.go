@@ -0,0 +1,247 @@
+package pusher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeriesExpiry(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\nttl: 1m\nendedinfo: true\n" +
+		"metricttl:\n  asaka_api_call_count: 10m\n  asaka_kernel_running_time: 0s\n"
+	p, err := NewAsaka(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.(*asaka)
+	if interval := a.expireInterval(); interval != 30*time.Second {
+		t.Errorf("actual expire interval: %v, expected: 30s", interval)
+	}
+	a.ParseAndPush("1504171516,1,0,1,TEST,983,4,2097154")
+	a.ParseAndPush("1504171516,2,0,1,0x7fb7ec062910,_Z13FFT512_deviceI6float2fEvPT_,130,10,2560,640")
+	session := map[string]string{"session": "0"}
+
+	a.expire(time.Now().Add(2 * time.Minute))
+	cases := []struct {
+		metric   string
+		expected float64
+		exists   bool
+	}{
+		{"asaka_api_running_time", 0, false},
+		{"asaka_api_call_count", 4, true},
+		{"asaka_kernel_running_time", 130, true},
+		{"asaka_kernel_thread_num", 0, false},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, session)
+		if ok != c.exists || res != c.expected {
+			t.Errorf("Case #%d, actual: %v %v, expected: %v %v", idx+1, res, ok, c.expected, c.exists)
+		}
+	}
+	expired, _ := gatheredValue(t, p, "hana_expired_series_total", map[string]string{"metric": "asaka_kernel_thread_num"})
+	if expired != 1 {
+		t.Errorf("actual expired series: %v, expected: 1", expired)
+	}
+	if _, ok := gatheredValue(t, p, "asaka_api_running_time_ended_timestamp_seconds", session); !ok {
+		t.Error("ended info of asaka_api_running_time not exposed")
+	}
+
+	a.expire(time.Now().Add(4 * time.Minute))
+	if _, ok := gatheredValue(t, p, "asaka_api_running_time_ended_timestamp_seconds", session); ok {
+		t.Error("ended info of asaka_api_running_time not removed")
+	}
+
+	if _, err := NewAsaka("ttl: forever\n"); err == nil {
+		t.Error("expected error for invalid ttl")
+	}
+	if _, err := NewAsaka("metricttl:\n  asaka_api_cal_count: 10m\n"); err == nil {
+		t.Error("expected error for metricttl of unknown metric")
+	}
+}
+
+func TestRecordingRules(t *testing.T) {
+	p, err := NewAsaka("pushurl: http://127.0.0.1:9091\npipeline: asaka\nrulefiles:\n  - ../tools/asaka.rules\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range asaka_monitor_data {
+		p.(*asaka).ParseAndPush(data)
+	}
+	if err := p.(*asaka).rules.Eval(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{"asaka_api_call_count_sum", map[string]string{"api": "cuModuleLoadData", "pipeline": "asaka"}, 2},
+		{"asaka_api_running_time_sum", map[string]string{"api": "TEST"}, 983},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+	if _, err := NewAsaka("rulefiles:\n  - does_not_exist.rules\n"); err == nil {
+		t.Errorf("missing rule file accepted")
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	regex, err := NewRegex(regex_conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regexCount, err := NewRegex(regex_conf + "unmatched: count\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	asaka, err := NewAsaka("logparsed: false\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		pusher   Pusher
+		line     string
+		expected string
+	}{
+		{asaka, "1504171516,1,0,1,TEST,983,4,2097154", ""},
+		{asaka, "", ""},
+		{asaka, "1504171516,1,0,1,TEST,983,x,2097154", "invalid_number: "},
+		{asaka, "1504171516,9,0", "unknown_type: "},
+		{regex, "1504171516,1,0,1,TEST,983", ""},
+		{regex, "unmatched", ""},
+		{regex, "", ""},
+		{regexCount, "unmatched", "unmatched: no pattern matched"},
+		{regexCount, " ", ""},
+	}
+
+	for idx, c := range cases {
+		err := c.pusher.(LineParser).ParseLine(c.line)
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if !strings.HasPrefix(actual, c.expected) || (len(c.expected) == 0) != (err == nil) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, actual, c.expected)
+		}
+	}
+	if v, ok := gatheredValue(t, asaka, "asaka_api_call_count", map[string]string{"api": "TEST"}); !ok || v != 4 {
+		t.Errorf("actual: %v %v, expected: 4 without pushurl by logparsed false", v, ok)
+	}
+}
+
+func TestDrainOnClose(t *testing.T) {
+	p, err := NewAsaka("logparsed: false\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := make(chan string, 100)
+	ts := time.Now().Unix()
+	for i := 1; i <= 100; i++ {
+		src <- fmt.Sprintf("%d,1,0,1,TEST,983,%d,2097154", ts, i)
+	}
+	close(src)
+	if err := p.Start(context.Background(), src); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("lines not drained")
+	}
+	if v, _ := gatheredValue(t, p, "asaka_api_call_count", map[string]string{"api": "TEST"}); v != 100 {
+		t.Errorf("actual: %v, expected: 100", v)
+	}
+	if err := p.Stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPusherLifecycle(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	cases := []struct {
+		conf   string
+		cancel bool
+		err    bool
+	}{
+		{"logparsed: false\n", false, false},
+		{"logparsed: false\n", true, false},
+		{"pushurl: " + failing.URL + "\npushretries: 0\n", false, true},
+	}
+
+	for idx, c := range cases {
+		p, err := NewAsaka(c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := p.Start(ctx, make(chan string)); err != nil {
+			t.Fatal(err)
+		}
+		if c.cancel {
+			cancel()
+			select {
+			case <-p.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Case #%d, pusher didn't end after its context was canceled", idx+1)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if err := p.Stop(); (err != nil) != c.err {
+				t.Errorf("Case #%d, actual: %v, expected error: %v", idx+1, err, c.err)
+			}
+		}
+		if _, ok := <-p.Errors(); ok {
+			t.Errorf("Case #%d, errors channel not closed", idx+1)
+		}
+		cancel()
+	}
+
+	p, err := NewAsaka("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(); err != nil {
+		t.Errorf("actual: %v, expected: nil for a pusher never started", err)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	csvMetric := func(name string) string {
+		return "records:\n  \"1\":\n    labels: {id: 2}\n    metrics:\n      - {column: 3, name: " + name + "}\n"
+	}
+	cases := []struct {
+		newPusher func(string) (Pusher, error)
+		conf      string
+		err       string
+	}{
+		{NewCSV, csvMetric("bad-name"), `invalid metric name "bad-name"`},
+		{NewCSV, csvMetric("9bad"), `invalid metric name "9bad"`},
+		{NewCSV, csvMetric("hana_parse_errors_total"), "metric hana_parse_errors_total: "},
+		{NewCSV, "records:\n  \"1\":\n    labels: {bad-label: 2}\n    metrics:\n      - {column: 3, name: x}\n", `invalid label name "bad-label"`},
+		{NewCSV, "records:\n  \"1\":\n    labels: {__id: 2}\n    metrics:\n      - {column: 3, name: x}\n", `invalid label name "__id"`},
+		{NewRegex, "rules:\n  - match: '(?P<a>\\w+) (?P<v>\\d+)'\n    labels: [a, a]\n    metrics:\n      - {value: v, name: x}\n", "duplicate label name a"},
+		{NewJSON, "labels: {pipeline: a}\nmetrics:\n  - {field: v, name: x}\n", `invalid label name "pipeline"`},
+		{NewRegex, "rules:\n  - match: '(?P<pipeline>\\w+) (?P<v>\\d+)'\n    labels: [pipeline]\n    metrics:\n      - {value: v, name: x}\n", `invalid label name "pipeline"`},
+		{NewJSON, "labels: {bad-label: a}\nmetrics:\n  - {field: v, name: x}\n", `invalid label name "bad-label"`},
+		{NewJSON, "metrics:\n  - {field: v, name: bad-name}\n", `invalid metric name "bad-name"`},
+		{NewGPUMeta, "types:\n  \"20\":\n    name: gpu_x\n    labels: {id: x}\n", "duplicate label name id"},
+	}
+
+	for idx, c := range cases {
+		_, err := c.newPusher(c.conf)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, c.err)
+		}
+	}
+}
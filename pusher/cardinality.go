@@ -0,0 +1,76 @@
+package pusher
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LabelValueCount is the number of series having a label value
+type LabelValueCount struct {
+	Value  string `json:"value"`
+	Series int    `json:"series"`
+}
+
+// LabelCardinality is the number of distinct values of a label and the values
+// with the most series
+type LabelCardinality struct {
+	Name   string            `json:"name"`
+	Values int               `json:"values"`
+	Top    []LabelValueCount `json:"top"`
+}
+
+// MetricCardinality is the number of series of a metric and its labels
+type MetricCardinality struct {
+	Name   string             `json:"name"`
+	Series int                `json:"series"`
+	Labels []LabelCardinality `json:"labels"`
+}
+
+// CardinalityReport reports the metrics gathered from g by descending series
+// count, each label lists its top n values driving the cardinality
+func CardinalityReport(g prometheus.Gatherer, n int) ([]MetricCardinality, error) {
+	mfs, err := g.Gather()
+	report := make([]MetricCardinality, 0, len(mfs))
+	for _, mf := range mfs {
+		counts := map[string]map[string]int{}
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				values, ok := counts[lp.GetName()]
+				if !ok {
+					values = map[string]int{}
+					counts[lp.GetName()] = values
+				}
+				values[lp.GetValue()]++
+			}
+		}
+		mc := MetricCardinality{Name: mf.GetName(), Series: len(mf.Metric)}
+		for name, values := range counts {
+			lc := LabelCardinality{Name: name, Values: len(values)}
+			for value, series := range values {
+				lc.Top = append(lc.Top, LabelValueCount{Value: value, Series: series})
+			}
+			sort.Slice(lc.Top, func(i, j int) bool {
+				if lc.Top[i].Series != lc.Top[j].Series {
+					return lc.Top[i].Series > lc.Top[j].Series
+				}
+				return lc.Top[i].Value < lc.Top[j].Value
+			})
+			if len(lc.Top) > n {
+				lc.Top = lc.Top[:n]
+			}
+			mc.Labels = append(mc.Labels, lc)
+		}
+		sort.Slice(mc.Labels, func(i, j int) bool {
+			if mc.Labels[i].Values != mc.Labels[j].Values {
+				return mc.Labels[i].Values > mc.Labels[j].Values
+			}
+			return mc.Labels[i].Name < mc.Labels[j].Name
+		})
+		report = append(report, mc)
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Series > report[j].Series
+	})
+	return report, err
+}
@@ -0,0 +1,109 @@
+package pusher
+
+import (
+	"testing"
+)
+
+func TestSeriesLimit(t *testing.T) {
+	cases := []struct {
+		conf     string
+		series   int
+		overflow bool
+		rejected float64
+	}{
+		{"pushurl: http://127.0.0.1:9091\nmaxseries: 2\n", 3, true, 4},
+		{"pushurl: http://127.0.0.1:9091\nmetricmaxseries:\n  asaka_kernel_call_count: 2\noverflow: drop\n", 2, false, 4},
+		{"pushurl: http://127.0.0.1:9091\n", 6, false, 0},
+	}
+	for idx, c := range cases {
+		p, err := NewAsaka(c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range asaka_monitor_data {
+			p.(*asaka).ParseAndPush(data)
+		}
+		report, err := CardinalityReport(p.Gatherer(), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mc := range report {
+			if mc.Name == "asaka_kernel_call_count" && mc.Series != c.series {
+				t.Errorf("Case #%d, actual series: %v, expected: %v", idx+1, mc.Series, c.series)
+			}
+		}
+		_, ok := gatheredValue(t, p, "asaka_kernel_call_count", map[string]string{"name": overflowValue})
+		if ok != c.overflow {
+			t.Errorf("Case #%d, actual overflow: %v, expected: %v", idx+1, ok, c.overflow)
+		}
+		rejected, _ := gatheredValue(t, p, "hana_rejected_series_total", map[string]string{"metric": "asaka_kernel_call_count"})
+		if rejected != c.rejected {
+			t.Errorf("Case #%d, actual rejected: %v, expected: %v", idx+1, rejected, c.rejected)
+		}
+	}
+	if _, err := NewAsaka("metricmaxseries:\n  asaka_kernel_calls: 2\n"); err == nil {
+		t.Error("expected error for metricmaxseries of unknown metric")
+	}
+}
+
+func TestSeriesLimitCumulative(t *testing.T) {
+	p, err := NewAsaka("pushurl: http://127.0.0.1:9091\nmaxseries: 1\naccumulation:\n  asaka_api_call_count: cumulative\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		"1504171516,1,0,1,A,10,10,0",
+		"1504171516,1,0,1,B,100,100,0",
+		"1504171516,1,0,1,C,5,5,0",
+		"1504171516,1,0,1,B,110,110,0",
+		"1504171516,1,0,1,A,12,12,0",
+	} {
+		p.(*asaka).ParseAndPush(data)
+	}
+	cases := []struct {
+		metric   string
+		labels   map[string]string
+		expected float64
+		exists   bool
+	}{
+		{"asaka_api_call_count", map[string]string{"api": "A"}, 12, true},
+		{"asaka_api_call_count", map[string]string{"api": overflowValue}, 0, false},
+		{"hana_rejected_series_total", map[string]string{"metric": "asaka_api_call_count"}, 3, true},
+		// gauges still fold series into overflow
+		{"asaka_api_running_time", map[string]string{"api": overflowValue}, 110, true},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if ok != c.exists || res != c.expected {
+			t.Errorf("Case #%d, actual: %v %v, expected: %v %v", idx+1, res, ok, c.expected, c.exists)
+		}
+	}
+}
+
+func TestCardinalityReport(t *testing.T) {
+	p, err := NewAsaka("pushurl: http://127.0.0.1:9091\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range asaka_monitor_data {
+		p.(*asaka).ParseAndPush(data)
+	}
+	report, err := CardinalityReport(p.Gatherer(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mc := range report {
+		if mc.Name != "asaka_kernel_call_count" {
+			continue
+		}
+		if mc.Series != 6 {
+			t.Errorf("actual series: %v, expected: 6", mc.Series)
+		}
+		top := mc.Labels[0]
+		if top.Name != "name" || top.Values != 6 || len(top.Top) != 1 {
+			t.Errorf("unexpected top label: %v", top)
+		}
+		return
+	}
+	t.Error("asaka_kernel_call_count not reported")
+}
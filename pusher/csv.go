@@ -0,0 +1,209 @@
+package pusher
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/olebedev/config"
+)
+
+// csvAnyRecord is the record type used for every line when no type column
+// is configured
+const csvAnyRecord = "*"
+
+// csvRecord maps the columns of one record type to labels and metrics
+type csvRecord struct {
+	labelNames   []string
+	labelColumns []int
+	values       []csvValue
+}
+
+type csvValue struct {
+	column int
+	metric *metric
+}
+
+// csv is a pusher mapping CSV columns to metrics entirely from config:
+//
+//	separator:  field separator, default ","
+//	typecolumn: column holding the record type, every line uses record "*" if omitted
+//	records:
+//	  "1":
+//	    labels:
+//	      session: 2
+//	    metrics:
+//	      - column: 5
+//	        name: asaka_api_running_time
+//	        help: api total running time
+//	        type: gauge
+//	        unit: ""
+type csv struct {
+	*base
+
+	separator  string
+	typeColumn int
+	records    map[string]*csvRecord
+}
+
+func NewCSV(conf string) (Pusher, error) {
+	cfg, err := config.ParseYaml(conf)
+	if err != nil {
+		return nil, err
+	}
+	c := &csv{
+		separator:  cfg.UString("separator", ","),
+		typeColumn: cfg.UInt("typecolumn", -1),
+		records:    map[string]*csvRecord{},
+	}
+	records, err := cfg.Map("records")
+	if err != nil {
+		return nil, fmt.Errorf("records are not configured, %v", err)
+	}
+	metrics := map[string]*metric{}
+	for recordType, v := range records {
+		rec, err := parseCSVRecord(v, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("record %s: %v", recordType, err)
+		}
+		c.records[recordType] = rec
+	}
+
+	c.base, err = newBase(cfg, c.ParseAndPush)
+	if err != nil {
+		return nil, err
+	}
+	// Metrics have to be registered to be exposed:
+	for _, m := range metrics {
+		if err := c.registerMetrics(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkMetricNames(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseCSVRecord parses a record declaration, metrics declared by several
+// records are shared through the metrics map
+func parseCSVRecord(v interface{}, metrics map[string]*metric) (*csvRecord, error) {
+	decl, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("record must be a map")
+	}
+	rec := &csvRecord{}
+	labels, _ := decl["labels"].(map[string]interface{})
+	for name := range labels {
+		rec.labelNames = append(rec.labelNames, name)
+	}
+	sort.Strings(rec.labelNames)
+	for _, name := range rec.labelNames {
+		column, err := intValue(labels[name])
+		if err != nil {
+			return nil, fmt.Errorf("label %s: %v", name, err)
+		}
+		rec.labelColumns = append(rec.labelColumns, column)
+	}
+	values, _ := decl["metrics"].([]interface{})
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no metrics declared")
+	}
+	for _, v := range values {
+		mdecl, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("metric must be a map")
+		}
+		spec, err := parseMetricSpec(mdecl)
+		if err != nil {
+			return nil, err
+		}
+		column, err := intValue(mdecl["column"])
+		if err != nil {
+			return nil, fmt.Errorf("metric %s column: %v", spec.name, err)
+		}
+		m, err := declareMetric(metrics, spec, rec.labelNames)
+		if err != nil {
+			return nil, err
+		}
+		rec.values = append(rec.values, csvValue{column: column, metric: m})
+	}
+	return rec, nil
+}
+
+func (c *csv) ParseAndPush(data string) {
+	if len(strings.TrimSpace(data)) == 0 {
+		// ignore
+		return
+	}
+	dataList := strings.Split(data, c.separator)
+	recordType := csvAnyRecord
+	if c.typeColumn >= 0 {
+		if len(dataList) <= c.typeColumn {
+			c.parseError(data, reasonShortLine, fmt.Errorf("%d fields, type in column %d", len(dataList), c.typeColumn))
+			return
+		}
+		recordType = strings.TrimSpace(dataList[c.typeColumn])
+	}
+	rec, ok := c.records[recordType]
+	if !ok {
+		c.parseError(data, reasonUnknownType, fmt.Errorf("unknown csv record type %s", recordType))
+		return
+	}
+	field := func(column int) (string, error) {
+		if column < 0 || column >= len(dataList) {
+			return "", fmt.Errorf("column %d out of range, %d fields", column, len(dataList))
+		}
+		return strings.TrimSpace(dataList[column]), nil
+	}
+
+	lvs := make([]string, len(rec.labelColumns))
+	for i, column := range rec.labelColumns {
+		lv, err := field(column)
+		if err != nil {
+			c.parseError(data, reasonMissingFields, err)
+			return
+		}
+		lvs[i] = lv
+	}
+	values := make([]float64, len(rec.values))
+	for i, v := range rec.values {
+		s, err := field(v.column)
+		if err != nil {
+			c.parseError(data, reasonMissingFields, err)
+			return
+		}
+		values[i], err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			c.parseError(data, reasonInvalidNumber, fmt.Errorf("metric %s: %v", v.metric.spec.fqName(), err))
+			return
+		}
+	}
+
+	if c.logParsed {
+		log.Printf("data parsed: TYPE: %s LABELS: %v VALUES: %v", recordType, lvs, values)
+		return
+	}
+	for i, v := range rec.values {
+		if err := v.metric.set(lvs, values[i]); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// intValue converts an integer config value
+func intValue(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), nil
+		}
+	case string:
+		return strconv.Atoi(n)
+	}
+	return 0, fmt.Errorf("integer expected, got %v", v)
+}
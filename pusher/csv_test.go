@@ -0,0 +1,93 @@
+package pusher
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatheredValue returns the value of the series of name with labels from p
+func gatheredValue(t *testing.T, p Pusher, name string, labels map[string]string) (float64, bool) {
+	mfs, err := p.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+	next:
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if v, ok := labels[lp.GetName()]; ok && v != lp.GetValue() {
+					continue next
+				}
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				return m.Counter.GetValue(), true
+			case dto.MetricType_GAUGE:
+				return m.Gauge.GetValue(), true
+			case dto.MetricType_UNTYPED:
+				return m.Untyped.GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestCSVPusher(t *testing.T) {
+	cases := []struct {
+		conf     string
+		data     []string
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{"../conf/csv_asaka.conf", asaka_monitor_data, "asaka_api_running_time",
+			map[string]string{"session": "0", "client_id": "1", "api": "TEST"}, 983},
+		{"../conf/csv_asaka.conf", asaka_monitor_data, "asaka_kernel_thread_num",
+			map[string]string{"name": "_Z13chk512_deviceI7double2EvPKT_iPc"}, 64},
+		{"../conf/csv_gpumeta.conf", gpu_monitor_data, "gpu_temperature",
+			map[string]string{"id": "2", "name": "Tesla P100-SXM2-16GB"}, 25},
+	}
+	for idx, c := range cases {
+		conf, err := ioutil.ReadFile(c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := NewCSV(string(conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range c.data {
+			p.(*csv).ParseAndPush(data)
+		}
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+}
+
+func TestCSVPusherConfig(t *testing.T) {
+	cases := []struct {
+		conf string
+		err  string
+	}{
+		{"typecolumn: 1\n", "records are not configured"},
+		{"records:\n  \"1\":\n    labels:\n      id: 2\n", "no metrics declared"},
+		{"records:\n  \"1\":\n    metrics:\n      - column: 1\n        name: x\n        type: histogram\n", "unknown type"},
+		{"records:\n  \"1\":\n    metrics:\n      - column: a\n        name: x\n", "column"},
+		{"records:\n  \"1\":\n    metrics:\n      - column: 1\n        name: x\n" +
+			"  \"2\":\n    metrics:\n      - column: 1\n        name: x\n        type: counter\n", "declared differently"},
+	}
+	for idx, c := range cases {
+		_, err := NewCSV(c.conf)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, err, c.err)
+		}
+	}
+}
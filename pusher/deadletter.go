@@ -0,0 +1,165 @@
+package pusher
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/olebedev/config"
+)
+
+const (
+	defaultDeadLetterMaxSize   = 10 << 20
+	defaultDeadLetterRetention = 3
+)
+
+// deadLetter appends lines rejected by the parser to a local file as JSON
+// lines, rotating it by size:
+//
+//	deadletter:           path of the file, disabled if empty
+//	deadlettermaxsize:    size in bytes after which the file is rotated, default 10MiB
+//	deadletterretention:  number of rotated files kept as <path>.1 .. <path>.N, default 3
+//
+// The file is opened when the pusher starts or a line is rejected, creating
+// the pusher doesn't touch it.
+type deadLetter struct {
+	path      string
+	pipeline  string
+	maxSize   int64
+	retention int
+	now       func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+// deadLetterRecord is a line of the dead-letter file
+type deadLetterRecord struct {
+	Time     time.Time `json:"time"`
+	Pipeline string    `json:"pipeline"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error"`
+	Line     string    `json:"line"`
+}
+
+// newDeadLetter returns nil if no dead-letter file is configured
+func newDeadLetter(cfg *config.Config) (*deadLetter, error) {
+	path := cfg.UString("deadletter")
+	if len(path) == 0 {
+		return nil, nil
+	}
+	d := &deadLetter{
+		path:      path,
+		pipeline:  pipelineName(cfg),
+		maxSize:   int64(cfg.UInt("deadlettermaxsize", defaultDeadLetterMaxSize)),
+		retention: cfg.UInt("deadletterretention", defaultDeadLetterRetention),
+		now:       time.Now,
+	}
+	if d.maxSize <= 0 {
+		return nil, fmt.Errorf("deadlettermaxsize must be positive")
+	}
+	if d.retention < 0 {
+		return nil, fmt.Errorf("deadletterretention must not be negative")
+	}
+	return d, nil
+}
+
+// open opens the file unless it is open already, it fails after close
+func (d *deadLetter) open() error {
+	if d.closed {
+		return fmt.Errorf("dead-letter file %s is closed", d.path)
+	}
+	if d.file != nil {
+		return nil
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d.file, d.size = f, info.Size()
+	return nil
+}
+
+// write appends a rejected line, the file is rotated first if the record
+// would exceed the max size
+func (d *deadLetter) write(line, reason string, cause error) error {
+	rec := deadLetterRecord{
+		Time:     d.now(),
+		Pipeline: d.pipeline,
+		Reason:   reason,
+		Line:     line,
+	}
+	if cause != nil {
+		rec.Error = cause.Error()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.open(); err != nil {
+		return err
+	}
+	if d.size > 0 && d.size+int64(len(b)) > d.maxSize {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := d.file.Write(b)
+	d.size += int64(n)
+	return err
+}
+
+// rotate shifts <path>.i to <path>.i+1, drops files beyond retention and
+// starts a new file
+func (d *deadLetter) rotate() error {
+	d.file.Close()
+	d.file = nil
+	if d.retention == 0 {
+		if err := os.Remove(d.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return d.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", d.path, d.retention))
+	for i := d.retention - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", d.path, i), fmt.Sprintf("%s.%d", d.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(d.path, d.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return d.open()
+}
+
+// start opens the file, errors of the path surface when the pusher starts
+func (d *deadLetter) start() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.open()
+}
+
+func (d *deadLetter) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
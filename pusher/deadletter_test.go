@@ -0,0 +1,181 @@
+package pusher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readDeadLetters(t *testing.T, path string) []deadLetterRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []deadLetterRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rejected.log")
+
+	p, err := NewGPUMeta("pushurl: http://127.0.0.1:9091\npipeline: gpu\ndeadletter: " + path + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.(*gpu_meta).ParseAndPush("2017/09/06 13:15:36.962,1,1,Tesla P100-SXM2-16GB,x")
+	p.(*gpu_meta).ParseAndPush("2017/09/06 13:15:36.962,1,1,Tesla P100-SXM2-16GB,27")
+	p.(*gpu_meta).ParseAndPush("2017/09/06 13:15:36.962,99,1,Tesla P100-SXM2-16GB,27")
+
+	recs := readDeadLetters(t, path)
+	cases := []deadLetterRecord{
+		{Pipeline: "gpu", Reason: reasonInvalidNumber, Line: "2017/09/06 13:15:36.962,1,1,Tesla P100-SXM2-16GB,x"},
+		{Pipeline: "gpu", Reason: reasonUnknownType, Line: "2017/09/06 13:15:36.962,99,1,Tesla P100-SXM2-16GB,27"},
+	}
+	if len(recs) != len(cases) {
+		t.Fatalf("actual: %d records, expected: %d", len(recs), len(cases))
+	}
+	for idx, c := range cases {
+		rec := recs[idx]
+		if rec.Pipeline != c.Pipeline || rec.Reason != c.Reason || rec.Line != c.Line ||
+			len(rec.Error) == 0 || rec.Time.IsZero() {
+			t.Errorf("Case #%d, actual: %+v, expected: %+v", idx+1, rec, c)
+		}
+	}
+}
+
+func TestDeadLetterParsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	csvConf := "records:\n  \"*\":\n    labels:\n      id: 0\n    metrics:\n      - column: 1\n        name: x\n"
+	cases := []struct {
+		new     func(string) (Pusher, error)
+		conf    string
+		lines   []string
+		reasons []string
+	}{
+		{NewCSV, csvConf, []string{"a,1", "a,x", "a"}, []string{reasonInvalidNumber, reasonMissingFields}},
+		{NewRegex, regex_conf + "unmatched: deadletter\n", []string{"1504171516,1,0,1,TEST,983", "unmatched"}, []string{reasonUnmatched}},
+		{NewJSON, json_conf, []string{json_monitor_data[0], "not json"}, []string{jsonErrInvalid}},
+	}
+
+	for idx, c := range cases {
+		path := filepath.Join(dir, fmt.Sprintf("rejected%d.log", idx+1))
+		p, err := c.new(c.conf + "\npipeline: p\ndeadletter: " + path + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range c.lines {
+			p.(LineParser).ParseLine(line)
+		}
+		p.Stop()
+		var reasons []string
+		for _, rec := range readDeadLetters(t, path) {
+			if rec.Pipeline != "p" || len(rec.Error) == 0 || !contains(c.lines, rec.Line) {
+				t.Errorf("Case #%d, actual: %+v, expected: a rejected line of pipeline p", idx+1, rec)
+			}
+			reasons = append(reasons, rec.Reason)
+		}
+		if fmt.Sprint(reasons) != fmt.Sprint(c.reasons) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, reasons, c.reasons)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeadLetterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rejected.log")
+
+	p, err := NewAsaka("deadletter: " + path + "\ndeadlettermaxsize: 300\ndeadletterretention: 2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		p.(*asaka).ParseAndPush("1502970051,1,0,2,cuda_init")
+	}
+	p.(*asaka).deadLetter.close()
+
+	cases := []struct {
+		path   string
+		exists bool
+	}{
+		{path, true},
+		{path + ".1", true},
+		{path + ".2", true},
+		{path + ".3", false},
+	}
+	for idx, c := range cases {
+		info, err := os.Stat(c.path)
+		if (err == nil) != c.exists {
+			t.Errorf("Case #%d, actual: %v, expected exists: %v", idx+1, err, c.exists)
+			continue
+		}
+		if c.exists && info.Size() > 300 {
+			t.Errorf("Case #%d, actual size: %d, expected at most 300", idx+1, info.Size())
+		}
+	}
+}
+
+func TestDeadLetterStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		path string
+		err  bool
+	}{
+		{filepath.Join(dir, "rejected.log"), false},
+		{filepath.Join(dir, "missing", "rejected.log"), true},
+	}
+
+	for idx, c := range cases {
+		p, err := NewAsaka("deadletter: " + c.path + "\n")
+		if err != nil {
+			t.Fatalf("Case #%d, actual: %v, expected: nil", idx+1, err)
+		}
+		if _, err := os.Stat(c.path); !os.IsNotExist(err) {
+			t.Errorf("Case #%d, actual: %v, expected: file created on start", idx+1, err)
+		}
+		err = p.Start(context.Background(), make(chan string))
+		if (err != nil) != c.err {
+			t.Errorf("Case #%d, actual: %v, expected error: %v", idx+1, err, c.err)
+		}
+		p.Stop()
+	}
+}
@@ -0,0 +1,256 @@
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+const (
+	defaultPushJob      = "hana"
+	defaultPushInterval = 15 * time.Second
+	defaultPushRetries  = 3
+	defaultPushBackoff  = time.Second
+	defaultPushTimeout  = 10 * time.Second
+)
+
+// gateway pushes the metric families of a pusher to a Prometheus Pushgateway
+type gateway struct {
+	url      string
+	interval time.Duration
+	retries  int
+	backoff  time.Duration
+	timeout  time.Duration
+	// mu guards delete, which is cleared by keep
+	mu       sync.Mutex
+	delete   bool
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	doneCh   chan struct{}
+}
+
+// newGateway creates a gateway from the push related keys of a pusher config:
+//
+//	pushurl:      base url of the Pushgateway
+//	pushjob:      job name of the grouping key, default "hana"
+//	pushinstance: instance label of the grouping key, default hostname
+//	pushgrouping: map of extra grouping labels
+//	pushinterval: interval between two pushes, default 15s
+//	pushretries:  retries of a failed push, default 3
+//	pushbackoff:  initial backoff between retries, doubled on each retry, default 1s
+//	pushtimeout:  timeout of a request, and of the final push and delete with their retries, default 10s
+//	pushdelete:   delete the group from the Pushgateway when stopped
+func newGateway(cfg *config.Config, g prometheus.Gatherer) (*gateway, error) {
+	pushurl, err := cfg.String("pushurl")
+	if err != nil || len(pushurl) == 0 {
+		return nil, fmt.Errorf("pushurl is not configured")
+	}
+	interval, err := time.ParseDuration(cfg.UString("pushinterval", defaultPushInterval.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pushinterval, %v", err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("pushinterval must be positive")
+	}
+	backoff, err := time.ParseDuration(cfg.UString("pushbackoff", defaultPushBackoff.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pushbackoff, %v", err)
+	}
+	timeout, err := time.ParseDuration(cfg.UString("pushtimeout", defaultPushTimeout.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pushtimeout, %v", err)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("pushtimeout must be positive")
+	}
+	instance := cfg.UString("pushinstance")
+	if len(instance) == 0 {
+		instance, _ = os.Hostname()
+	}
+	grouping := map[string]string{}
+	for k, v := range cfg.UMap("pushgrouping") {
+		grouping[k] = fmt.Sprint(v)
+	}
+	if len(instance) > 0 {
+		grouping["instance"] = instance
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &gateway{
+		url:      groupingURL(pushurl, cfg.UString("pushjob", defaultPushJob), grouping),
+		interval: interval,
+		retries:  cfg.UInt("pushretries", defaultPushRetries),
+		backoff:  backoff,
+		timeout:  timeout,
+		delete:   cfg.UBool("pushdelete", false),
+		gatherer: g,
+		client:   &http.Client{Timeout: timeout},
+		ctx:      ctx,
+		cancel:   cancel,
+		doneCh:   make(chan struct{}),
+	}, nil
+}
+
+// groupingURL builds the Pushgateway url of a job and its grouping labels,
+// values which can't be expressed in a path segment are base64 encoded
+func groupingURL(base, job string, grouping map[string]string) string {
+	u := strings.TrimSuffix(base, "/") + "/metrics/" + groupingSegment("job", job)
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u += "/" + groupingSegment(name, grouping[name])
+	}
+	return u
+}
+
+func groupingSegment(name, value string) string {
+	if len(value) == 0 {
+		return name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return name + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// start pushes metrics periodically until stop is called
+func (g *gateway) start() {
+	go func() {
+		defer close(g.doneCh)
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := g.push(g.ctx); err != nil && g.ctx.Err() == nil {
+					log.Println("failed to push metrics,", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop aborts a periodic push in progress, performs a final push and deletes
+// the group if configured, all within pushtimeout so a dead Pushgateway
+// doesn't hold up stopping the pusher
+func (g *gateway) stop() error {
+	g.cancel()
+	<-g.doneCh
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	if err := g.push(ctx); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	del := g.delete
+	g.mu.Unlock()
+	if del {
+		return g.retry(ctx, func() error { return g.send(ctx, http.MethodDelete, nil) })
+	}
+	return nil
+}
+
+// keep makes stop skip deleting the group
+func (g *gateway) keep() {
+	g.mu.Lock()
+	g.delete = false
+	g.mu.Unlock()
+}
+
+// push replaces the group on the Pushgateway with the gathered metrics,
+// timestamps are dropped since the Pushgateway rejects pushed samples with them
+func (g *gateway) push(ctx context.Context) error {
+	mfs, err := g.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	enc := expfmt.NewEncoder(buf, expfmt.FmtText)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.TimestampMs = nil
+		}
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return g.retry(ctx, func() error { return g.send(ctx, http.MethodPut, buf.Bytes()) })
+}
+
+// retry calls fn until it succeeds, returns a permanent error, the retries
+// are exhausted or ctx is done
+func (g *gateway) retry(ctx context.Context, fn func() error) error {
+	backoff := g.backoff
+	err := fn()
+	for i := 0; err != nil && retryable(err) && i < g.retries; i++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// statusError is a non 2xx response of the Pushgateway
+type statusError struct {
+	code   int
+	method string
+	url    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s %s", e.code, e.method, e.url)
+}
+
+// retryable reports whether a failed request may succeed when retried,
+// network errors and server errors are, client errors are not
+func retryable(err error) bool {
+	if se, ok := err.(*statusError); ok {
+		return se.code >= 500
+	}
+	return true
+}
+
+func (g *gateway) send(ctx context.Context, method string, body []byte) error {
+	req, err := http.NewRequest(method, g.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", string(expfmt.FmtText))
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &statusError{code: resp.StatusCode, method: method, url: g.url}
+	}
+	return nil
+}
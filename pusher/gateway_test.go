@@ -0,0 +1,204 @@
+package pusher
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type gatewayRequest struct {
+	method string
+	path   string
+	body   string
+}
+
+func TestGroupingURL(t *testing.T) {
+	cases := []struct {
+		job      string
+		grouping map[string]string
+		expected string
+	}{
+		{"hana", nil, "http://gw:9091/metrics/job/hana"},
+		{"hana", map[string]string{"instance": "node1", "rack": "r1"}, "http://gw:9091/metrics/job/hana/instance/node1/rack/r1"},
+		{"a/b", map[string]string{"empty": ""}, "http://gw:9091/metrics/job@base64/YS9i/empty@base64/="},
+	}
+	for idx, c := range cases {
+		res := groupingURL("http://gw:9091/", c.job, c.grouping)
+		if res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+}
+
+func TestGatewayPush(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []gatewayRequest
+		fail     = 2
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, gatewayRequest{r.Method, r.URL.Path, string(body)})
+		if fail > 0 {
+			fail--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "test gauge"}, []string{"id"})
+	gauge.WithLabelValues("1").Set(42)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+
+	cfg, err := config.ParseYaml("pushurl: " + server.URL + "\npushjob: test\npushinstance: node1\n" +
+		"pushgrouping:\n  rack: r1\npushinterval: 1h\npushbackoff: 1ms\npushdelete: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := newGateway(cfg, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.start()
+	if err := gw.stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 4 {
+		t.Fatalf("actual requests: %d, expected: 4", len(requests))
+	}
+	for idx, req := range requests {
+		if req.path != "/metrics/job/test/instance/node1/rack/r1" {
+			t.Errorf("Request #%d, actual path: %v", idx+1, req.path)
+		}
+	}
+	push := requests[2]
+	if push.method != http.MethodPut || !strings.Contains(push.body, `test_gauge{id="1"} 42`) {
+		t.Errorf("unexpected push request: %v", push)
+	}
+	if requests[3].method != http.MethodDelete {
+		t.Errorf("actual method: %v, expected: %v", requests[3].method, http.MethodDelete)
+	}
+}
+
+func TestGatewayRetry(t *testing.T) {
+	cases := []struct {
+		status   int
+		expected int
+	}{
+		{http.StatusAccepted, 1},
+		{http.StatusBadRequest, 1},
+		{http.StatusNotFound, 1},
+		{http.StatusInternalServerError, 4},
+		{http.StatusServiceUnavailable, 4},
+	}
+	for idx, c := range cases {
+		var (
+			mu       sync.Mutex
+			requests int
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+			w.WriteHeader(c.status)
+		}))
+		cfg, err := config.ParseYaml("pushurl: " + server.URL + "\npushretries: 3\npushbackoff: 1ms\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw, err := newGateway(cfg, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw.push(context.Background())
+		server.Close()
+		if requests != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, requests, c.expected)
+		}
+	}
+}
+
+func TestGatewayTimestamps(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "test gauge"})
+	gauge.Set(42)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := registry.Gather()
+		ts := int64(1500000000000)
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				m.TimestampMs = &ts
+			}
+		}
+		return mfs, err
+	})
+
+	cfg, err := config.ParseYaml("pushurl: " + server.URL + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := newGateway(cfg, gatherer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "test_gauge 42\n") || strings.Contains(body, "1500000000000") {
+		t.Errorf("actual body: %q, expected no timestamp", body)
+	}
+}
+
+func TestGatewayStopUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	cfg, err := config.ParseYaml("pushurl: " + server.URL + "\npushinterval: 1ms\npushbackoff: 1h\n" +
+		"pushtimeout: 100ms\npushdelete: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := newGateway(cfg, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.start()
+	// let a periodic push wait on its backoff
+	time.Sleep(50 * time.Millisecond)
+	errCh := make(chan error, 1)
+	go func() { errCh <- gw.stop() }()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("expected an error from an unreachable Pushgateway")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop is blocked by an unreachable Pushgateway")
+	}
+}
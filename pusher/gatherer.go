@@ -0,0 +1,73 @@
+package pusher
+
+import (
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// PipelineLabel is the constant label distinguishing metrics of pipelines
+// running in the same process
+const PipelineLabel = "pipeline"
+
+// pipelineGatherer adds constant labels to every metric gathered from
+// a pipeline registry
+type pipelineGatherer struct {
+	gatherer prometheus.Gatherer
+	labels   prometheus.Labels
+}
+
+// pipelineName is the "pipeline" key of the config and defaults to "filepath"
+func pipelineName(cfg *config.Config) string {
+	return cfg.UString("pipeline", cfg.UString("filepath"))
+}
+
+// newPipelineGatherer labels metrics of g with the pipeline name and the
+// "constlabels" map of the config
+func newPipelineGatherer(cfg *config.Config, g prometheus.Gatherer) prometheus.Gatherer {
+	labels := prometheus.Labels{}
+	for name, v := range cfg.UMap("constlabels") {
+		labels[name] = stringValue(v)
+	}
+	if name := pipelineName(cfg); len(name) > 0 {
+		labels[PipelineLabel] = name
+	}
+	if len(labels) == 0 {
+		return g
+	}
+	return &pipelineGatherer{
+		gatherer: g,
+		labels:   labels,
+	}
+}
+
+func (p *pipelineGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := p.gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for name, value := range p.labels {
+				if hasLabel(m, name) {
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(name),
+					Value: proto.String(value),
+				})
+			}
+			sort.Sort(prometheus.LabelPairSorter(m.Label))
+		}
+	}
+	return mfs, err
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
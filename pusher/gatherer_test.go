@@ -0,0 +1,85 @@
+package pusher
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPipelineGatherer(t *testing.T) {
+	var gatherers prometheus.Gatherers
+	for _, name := range []string{"container1", "container2"} {
+		p, err := NewAsaka("pipeline: " + name + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.(*asaka).apiCallcountMetric.set([]string{"0", "1", "cuda_init"}, 1)
+		gatherers = append(gatherers, p.Gatherer())
+	}
+	mfs, err := gatherers.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipelines := map[string]bool{}
+	for _, mf := range mfs {
+		if mf.GetName() != "asaka_api_call_count" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				if lp.GetName() == PipelineLabel {
+					pipelines[lp.GetValue()] = true
+				}
+			}
+		}
+	}
+	if !pipelines["container1"] || !pipelines["container2"] {
+		t.Errorf("actual pipelines: %v, expected: container1 and container2", pipelines)
+	}
+}
+
+func TestPipelineGathererConstLabels(t *testing.T) {
+	cases := []struct {
+		conf     string
+		expected map[string]string
+	}{
+		{"pipeline: gpu0\n", map[string]string{"pipeline": "gpu0"}},
+		{"pipeline: gpu0\nconstlabels:\n  node: n1\n  rack: 2\n", map[string]string{"pipeline": "gpu0", "node": "n1", "rack": "2"}},
+		{"constlabels:\n  node: n1\n", map[string]string{"node": "n1"}},
+		{"", map[string]string{}},
+	}
+
+	for idx, c := range cases {
+		p, err := NewAsaka(c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.(*asaka).apiCallcountMetric.set([]string{"0", "1", "cuda_init"}, 1)
+		mfs, err := p.Gatherer().Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := map[string]string{}
+		for _, mf := range mfs {
+			if mf.GetName() != "asaka_api_call_count" {
+				continue
+			}
+			for _, lp := range mf.Metric[0].Label {
+				switch lp.GetName() {
+				case "session", "client_id", "api":
+				default:
+					actual[lp.GetName()] = lp.GetValue()
+				}
+			}
+		}
+		if len(actual) != len(c.expected) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, actual, c.expected)
+			continue
+		}
+		for name, value := range c.expected {
+			if actual[name] != value {
+				t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, actual, c.expected)
+			}
+		}
+	}
+}
@@ -1,13 +1,14 @@
 package pusher
 
 import (
-	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/olebedev/config"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 type GPUMetaLogType int
@@ -19,114 +20,247 @@ const (
 	GPU_TEMPERATURE
 	PCIE_BW_RX
 	PCIE_BW_TX
+	GPU_POWER
+	GPU_SM_CLOCK
+	GPU_MEMORY_CLOCK
+	GPU_ECC_SINGLE_BIT
+	GPU_ECC_DOUBLE_BIT
+	GPU_FAN_SPEED
+	GPU_ENCODER_UTIL
+	GPU_DECODER_UTIL
+	GPU_MEMORY_USED
+	GPU_MEMORY_TOTAL
+	GPU_PROCESS_MEMORY
 )
 
 type gpu_meta struct {
-	pushUrl string
-	source  chan string
-	quitCh  chan struct{}
-	running bool
+	*base
+
+	lineTime *lineTime
+
+	types     map[GPUMetaLogType]*gpuMetaType
+	processes *gpuProcesses
 }
 
-var (
-	gpuLabelList  = []string{"id", "name"}
-	pcieLabelList = []string{"id", "name"}
-	gpuUtilMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "gpu_utilization",
-			Help: "gpu core utlization",
-		},
-		gpuLabelList,
-	)
-	gpuMemMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "gpu_memory_utilization",
-			Help: "gpu memory utlization",
-		},
-		gpuLabelList,
-	)
-	gpuTempMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "gpu_temperature",
-			Help: "gpu temperature in C degree",
-		},
-		gpuLabelList,
-	)
-	pcieBWRXMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "pcie_bandwidth_rx",
-			Help: "pcie bandwidth rx in MB",
-		},
-		pcieLabelList,
-	)
-	pcieBWTXMetric = prometheus.NewGaugeVec(
-		prometheus.GaugeOpts{
-			Name: "pcie_bandwidth_tx",
-			Help: "pcie bandwidth tx in MB",
-		},
-		pcieLabelList,
-	)
-)
+var gpuLabelList = []string{"id", "name"}
+
+// gpuMetaTimestampLayout is the default layout of the gpumeta timestamp
+// column, e.g. 2017/09/18 00:28:08.188
+const gpuMetaTimestampLayout = "2006/01/02 15:04:05.000"
+
+// gpuMetaType maps the value of a gpumeta record type to a metric, the
+// value is multiplied by scale to convert it to the unit of the metric and
+// labels are constant labels of the type, e.g. to share a metric by types
+type gpuMetaType struct {
+	spec   metricSpec
+	scale  float64
+	labels map[string]string
+
+	metric      *metric
+	labelValues []string
+}
+
+// gpuMetaTypes are the built-in record types, values are reported in the
+// units of nvidia-smi: percent, C, MB/s, W, MHz, error count and MiB
+var gpuMetaTypes = map[GPUMetaLogType]gpuMetaType{
+	GPU_UTIL:        {spec: metricSpec{name: "gpu_utilization", help: "gpu core utlization"}},
+	GPU_MEMORY:      {spec: metricSpec{name: "gpu_memory_utilization", help: "gpu memory utlization"}},
+	GPU_TEMPERATURE: {spec: metricSpec{name: "gpu_temperature", help: "gpu temperature in C degree"}},
+	PCIE_BW_RX:      {spec: metricSpec{name: "pcie_bandwidth_rx", help: "pcie bandwidth rx in MB"}},
+	PCIE_BW_TX:      {spec: metricSpec{name: "pcie_bandwidth_tx", help: "pcie bandwidth tx in MB"}},
+	GPU_POWER:       {spec: metricSpec{name: "gpu_power", unit: "watts", help: "gpu power draw"}},
+	GPU_SM_CLOCK: {
+		spec:  metricSpec{name: "gpu_sm_clock", unit: "hertz", help: "gpu streaming multiprocessor clock"},
+		scale: 1e6,
+	},
+	GPU_MEMORY_CLOCK: {
+		spec:  metricSpec{name: "gpu_memory_clock", unit: "hertz", help: "gpu memory clock"},
+		scale: 1e6,
+	},
+	GPU_ECC_SINGLE_BIT: {
+		spec:   metricSpec{name: "gpu_ecc_errors", unit: "total", help: "gpu ecc errors", typ: metricTypeCounter, accumulation: accumulationCumulative},
+		labels: map[string]string{"bit": "single"},
+	},
+	GPU_ECC_DOUBLE_BIT: {
+		spec:   metricSpec{name: "gpu_ecc_errors", unit: "total", help: "gpu ecc errors", typ: metricTypeCounter, accumulation: accumulationCumulative},
+		labels: map[string]string{"bit": "double"},
+	},
+	GPU_FAN_SPEED: {
+		spec:  metricSpec{name: "gpu_fan_speed", unit: "ratio", help: "gpu fan speed relative to its maximum"},
+		scale: 0.01,
+	},
+	GPU_ENCODER_UTIL: {
+		spec:  metricSpec{name: "gpu_encoder_utilization", unit: "ratio", help: "gpu video encoder utilization"},
+		scale: 0.01,
+	},
+	GPU_DECODER_UTIL: {
+		spec:  metricSpec{name: "gpu_decoder_utilization", unit: "ratio", help: "gpu video decoder utilization"},
+		scale: 0.01,
+	},
+	GPU_MEMORY_USED: {
+		spec:  metricSpec{name: "gpu_memory_used", unit: "bytes", help: "gpu memory used"},
+		scale: 1 << 20,
+	},
+	GPU_MEMORY_TOTAL: {
+		spec:  metricSpec{name: "gpu_memory_total", unit: "bytes", help: "gpu memory total"},
+		scale: 1 << 20,
+	},
+}
 
+// NewGPUMeta creates the gpumeta pusher, the "types" map adds record types
+// or replaces built-in ones:
+//
+//	types:
+//	  "20":
+//	    name: gpu_throttle_reasons
+//	    help: active clock throttle reasons
+//	    scale: 1
+//	    labels:
+//	      source: nvml
+//
+// with the keys of a metric declaration, the value is multiplied by scale,
+// which defaults to 1 and must not be 0.
 func NewGPUMeta(conf string) (Pusher, error) {
 	cfg, err := config.ParseYaml(conf)
 	if err != nil {
 		return nil, err
 	}
-	pushurl, err := cfg.String("pushurl")
+	g := &gpu_meta{types: map[GPUMetaLogType]*gpuMetaType{}}
+	for logType, t := range gpuMetaTypes {
+		t := t
+		g.types[logType] = &t
+	}
+	for key, v := range cfg.UMap("types") {
+		logType, err := strconv.ParseInt(key, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gpu meta log type %q", key)
+		}
+		if GPUMetaLogType(logType) == GPU_PROCESS_MEMORY {
+			return nil, fmt.Errorf("gpu meta log type %s is reserved for process records", key)
+		}
+		t, err := parseGPUMetaType(v)
+		if err != nil {
+			return nil, fmt.Errorf("gpu meta log type %s: %v", key, err)
+		}
+		g.types[GPUMetaLogType(logType)] = t
+	}
+	metrics := map[string]*metric{}
+	logTypes := make([]int, 0, len(g.types))
+	for logType := range g.types {
+		logTypes = append(logTypes, int(logType))
+	}
+	// declare in order of types so that conflicts are reported deterministically
+	sort.Ints(logTypes)
+	var declared []*metric
+	for _, logType := range logTypes {
+		t := g.types[GPUMetaLogType(logType)]
+		// built-in types without scale keep the value
+		if t.scale == 0 {
+			t.scale = 1
+		}
+		labelNames := append([]string(nil), gpuLabelList...)
+		names := make([]string, 0, len(t.labels))
+		for name := range t.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			labelNames = append(labelNames, name)
+			t.labelValues = append(t.labelValues, t.labels[name])
+		}
+		_, seen := metrics[t.spec.fqName()]
+		if t.metric, err = declareMetric(metrics, t.spec, labelNames); err != nil {
+			return nil, err
+		}
+		if !seen {
+			declared = append(declared, t.metric)
+		}
+	}
+
+	g.lineTime, err = newLineTime(cfg, gpuMetaTimestampLayout)
+	if err != nil {
+		return nil, err
+	}
+	g.processes, err = newGPUProcesses(cfg)
 	if err != nil {
-		pushurl = ""
+		return nil, err
+	}
+	g.base, err = newBase(cfg, g.ParseAndPush)
+	if err != nil {
+		return nil, err
+	}
+	if g.processes.interval > 0 {
+		g.housekeeping = g.processes.removeExited
+		g.housekeepingInterval = g.processes.interval
 	}
 	// Metrics have to be registered to be exposed:
-	prometheus.MustRegister(gpuUtilMetric)
-	prometheus.MustRegister(gpuMemMetric)
-	prometheus.MustRegister(gpuTempMetric)
-	prometheus.MustRegister(pcieBWRXMetric)
-	prometheus.MustRegister(pcieBWTXMetric)
-
-	return &gpu_meta{
-		pushUrl: pushurl,
-		quitCh:  make(chan struct{}, 1),
-	}, nil
-}
+	g.registry.MustRegister(g.lineTime.collectors()...)
+	if err := g.registerMetrics(append(declared, g.processes.metric)...); err != nil {
+		return nil, err
+	}
 
-func (g *gpu_meta) Start(src chan string) error {
-	g.source = src
-	go func() {
-		for {
-			select {
-			case <-g.quitCh:
-				g.running = false
-				return
-			case line := <-g.source:
-				g.ParseAndPush(line)
-			}
-		}
-	}()
-	return nil
+	if err := g.checkMetricNames(); err != nil {
+		return nil, err
+	}
+	return g, nil
 }
 
-func (g *gpu_meta) Stop() error {
-	if !g.running {
-		return errors.New("not running")
+// parseGPUMetaType parses a record type declaration of the config
+func parseGPUMetaType(v interface{}) (*gpuMetaType, error) {
+	decl, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("type must be a map")
+	}
+	spec, err := parseMetricSpec(decl)
+	if err != nil {
+		return nil, err
+	}
+	t := &gpuMetaType{spec: spec, scale: 1, labels: map[string]string{}}
+	if decl["scale"] != nil {
+		if t.scale, err = numberValue(decl["scale"]); err != nil {
+			return nil, fmt.Errorf("scale: %v", err)
+		}
+		if t.scale == 0 {
+			return nil, fmt.Errorf("scale must not be 0")
+		}
+	}
+	labels, _ := decl["labels"].(map[string]interface{})
+	for name, value := range labels {
+		t.labels[name] = stringValue(value)
 	}
-	g.quitCh <- struct{}{}
-	return nil
+	return t, nil
 }
 
 func (g *gpu_meta) ParseAndPush(data string) {
 	dataList := strings.Split(data, ",")
 	if len(dataList) < 2 {
-		// ignore
+		if len(strings.TrimSpace(data)) > 0 {
+			g.parseError(data, reasonShortLine, fmt.Errorf("%d fields", len(dataList)))
+		}
 		return
 	}
 	logType, err := strconv.ParseInt(dataList[1], 10, 8)
 	if err != nil {
-		log.Println("failed to parse gpu_meta log type,", err)
+		g.parseError(data, reasonInvalidType, err)
 		return
 	}
 	if len(dataList) < 5 {
-		log.Println("incorrect gpu_meta log format")
+		g.parseError(data, reasonMissingFields, fmt.Errorf("%d fields, expected 5", len(dataList)))
+		return
+	}
+
+	ts, ok, err := g.lineTime.check(dataList[0])
+	if err != nil {
+		g.parseError(data, reasonInvalidTimestamp, err)
+		return
+	}
+	if !ok {
+		// too old
+		return
+	}
+
+	if GPUMetaLogType(logType) == GPU_PROCESS_MEMORY {
+		g.parseAndPushProcess(data, dataList, ts)
 		return
 	}
 
@@ -135,33 +269,52 @@ func (g *gpu_meta) ParseAndPush(data string) {
 
 	value, err := strconv.ParseFloat(strings.TrimSpace(dataList[4]), 64)
 	if err != nil {
-		log.Println("data format error for parsing", err)
+		g.parseError(data, reasonInvalidNumber, err)
 		return
 	}
 
-	labels := prometheus.Labels{
-		"id":   gpu_id,
-		"name": gpu_name,
+	t, ok := g.types[GPUMetaLogType(logType)]
+	if !ok {
+		g.parseError(data, reasonUnknownType, fmt.Errorf("unknown gpu meta log type %d", logType))
+		return
 	}
-	if len(g.pushUrl) == 0 {
+	lvs := append([]string{gpu_id, gpu_name}, t.labelValues...)
+	if g.logParsed {
 		log.Printf("data parsed: TYPE: %d GPUID: %s NAME: %s VALUE: %f",
 			logType, gpu_id, gpu_name, value)
 		return
 	}
 
-	switch GPUMetaLogType(logType) {
-	case GPU_UTIL:
-		gpuUtilMetric.With(labels).Set(value)
-	case GPU_MEMORY:
-		gpuMemMetric.With(labels).Set(value)
-	case GPU_TEMPERATURE:
-		gpuTempMetric.With(labels).Set(value)
-	case PCIE_BW_RX:
-		pcieBWRXMetric.With(labels).Set(value)
-	case PCIE_BW_TX:
-		pcieBWTXMetric.With(labels).Set(value)
-	default:
-		log.Println("unknown gpu meta log type,", logType)
+	if err := t.metric.setAt(lvs, value*t.scale, ts); err != nil {
+		log.Println(err)
 	}
 	return
 }
+
+// parseAndPushProcess handles the process records:
+// timestamp,16,gpu id,pid,process name,used memory in MiB
+func (g *gpu_meta) parseAndPushProcess(data string, dataList []string, ts time.Time) {
+	if len(dataList) < 6 {
+		g.parseError(data, reasonMissingFields, fmt.Errorf("%d fields, expected 6", len(dataList)))
+		return
+	}
+	gpu_id := dataList[2]
+	lvs, pid, err := g.processes.labelValues(gpu_id, dataList[3], dataList[4])
+	if err != nil {
+		g.parseError(data, reasonInvalidNumber, err)
+		return
+	}
+	used, err := strconv.ParseFloat(strings.TrimSpace(dataList[5]), 64)
+	if err != nil {
+		g.parseError(data, reasonInvalidNumber, err)
+		return
+	}
+	if g.logParsed {
+		log.Printf("data parsed: TYPE: %d GPUID: %s PID: %d PROCESS: %s CONTAINER: %s USED: %f",
+			GPU_PROCESS_MEMORY, gpu_id, pid, lvs[2], lvs[3], used)
+		return
+	}
+	if err := g.processes.set(pid, lvs, used*(1<<20), ts); err != nil {
+		log.Println(err)
+	}
+}
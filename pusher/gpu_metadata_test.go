@@ -1,8 +1,11 @@
 package pusher
 
 import (
+	"context"
 	"testing"
 	"time"
+
+	"github.com/ksang/hana/lifecycle"
 )
 
 var (
@@ -26,18 +29,93 @@ func TestGpuMetaPusher(t *testing.T) {
 		return
 	}
 	src := make(chan string, 1)
-	err = pusher.Start(src)
+	err = pusher.Start(context.Background(), src)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	if err := pusher.Start(context.Background(), src); err != lifecycle.ErrStarted {
+		t.Errorf("actual: %v, expected: %v", err, lifecycle.ErrStarted)
+	}
 
 	go func() {
 		for _, data := range gpu_monitor_data {
-			time.Sleep(200 * time.Millisecond)
+			time.Sleep(20 * time.Millisecond)
 			src <- data
 		}
+		close(src)
 	}()
-	time.Sleep(5 * time.Second)
-	pusher.Stop()
+	select {
+	case <-pusher.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("pusher didn't end after the datasource channel was closed")
+	}
+	for i := 0; i < 2; i++ {
+		if err := pusher.Stop(); err != nil {
+			t.Errorf("Stop #%d, actual: %v, expected: nil", i+1, err)
+		}
+	}
+}
+
+func TestGpuMetaTypes(t *testing.T) {
+	conf := "pushurl: http://127.0.0.1:9091\n" +
+		"types:\n" +
+		"  \"20\":\n" +
+		"    name: gpu_throttled\n" +
+		"    scale: 2\n" +
+		"    labels:\n" +
+		"      source: nvml\n"
+	p, err := NewGPUMeta(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{
+		"2017/09/18 00:28:08.188,3,1,Tesla P100-SXM2-16GB,27",
+		"2017/09/18 00:28:08.188,6,1,Tesla P100-SXM2-16GB,52.5",
+		"2017/09/18 00:28:08.188,7,1,Tesla P100-SXM2-16GB,1328",
+		"2017/09/18 00:28:08.188,9,1,Tesla P100-SXM2-16GB,3",
+		"2017/09/18 00:28:09.188,9,1,Tesla P100-SXM2-16GB,5",
+		"2017/09/18 00:28:08.188,10,1,Tesla P100-SXM2-16GB,1",
+		"2017/09/18 00:28:08.188,11,1,Tesla P100-SXM2-16GB,40",
+		"2017/09/18 00:28:08.188,14,1,Tesla P100-SXM2-16GB,2",
+		"2017/09/18 00:28:08.188,20,1,Tesla P100-SXM2-16GB,3",
+	} {
+		p.(*gpu_meta).ParseAndPush(data)
+	}
+
+	cases := []struct {
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{"gpu_temperature", map[string]string{"id": "1"}, 27},
+		{"gpu_power_watts", map[string]string{"id": "1"}, 52.5},
+		{"gpu_sm_clock_hertz", map[string]string{"id": "1"}, 1328e6},
+		{"gpu_ecc_errors_total", map[string]string{"bit": "single"}, 5},
+		{"gpu_ecc_errors_total", map[string]string{"bit": "double"}, 1},
+		{"gpu_fan_speed_ratio", map[string]string{"id": "1"}, 0.4},
+		{"gpu_memory_used_bytes", map[string]string{"id": "1"}, 2 << 20},
+		{"gpu_throttled", map[string]string{"source": "nvml"}, 6},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+}
+
+func TestGpuMetaTypesInvalid(t *testing.T) {
+	cases := []string{
+		"types:\n  x:\n    name: gpu_x\n",
+		"types:\n  \"20\":\n    help: no name\n",
+		"types:\n  \"20\":\n    name: gpu_power\n    unit: watts\n    type: counter\n",
+		"types:\n  \"20\":\n    name: gpu_x\n    scale: fast\n",
+		"types:\n  \"20\":\n    name: gpu_x\n    scale: 0\n",
+	}
+	for idx, c := range cases {
+		if _, err := NewGPUMeta(c); err == nil {
+			t.Errorf("Case #%d, actual: nil, expected: error", idx+1)
+		}
+	}
 }
@@ -0,0 +1,183 @@
+package pusher
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/procfs"
+)
+
+const defaultProcessInterval = 10 * time.Second
+
+var gpuProcessLabelList = []string{"gpu", "pid", "process", "container"}
+
+// containerIDPattern matches container ids in cgroup paths of docker,
+// containerd and cri-o, e.g. /docker/<id> or cri-containerd-<id>.scope
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// gpuProcesses tracks the per-process gpumeta records:
+//
+//	timestamp,16,gpu id,pid,process name,used memory in MiB
+//
+// processes are attributed to containers by /proc/<pid>/cgroup, the series
+// of a process are removed once it has no record for processinterval and it
+// doesn't exist in procfs:
+//
+//	procfs:           mount point of the proc filesystem, default /proc
+//	processinterval:  interval of checking for exited processes, default 10s,
+//	                  0 disables the check, e.g. when procfs doesn't show the
+//	                  processes of the records
+type gpuProcesses struct {
+	fs       procfs.FS
+	interval time.Duration
+	metric   *metric
+
+	processes map[int]*gpuProcess
+	// containers caches the container ids read from procfs
+	containers map[processKey]string
+}
+
+// gpuProcess holds the label values of the series of a process and the time
+// of its last record
+type gpuProcess struct {
+	name    string
+	series  [][]string
+	updated time.Time
+}
+
+// processKey identifies a process by pid and name, as pids are reused
+type processKey struct {
+	pid  int
+	name string
+}
+
+func newGPUProcesses(cfg *config.Config) (*gpuProcesses, error) {
+	fs, err := procfs.NewFS(cfg.UString("procfs", procfs.DefaultMountPoint))
+	if err != nil {
+		return nil, err
+	}
+	interval, err := time.ParseDuration(cfg.UString("processinterval", defaultProcessInterval.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid processinterval, %v", err)
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("processinterval must not be negative")
+	}
+	return &gpuProcesses{
+		fs:       fs,
+		interval: interval,
+		metric: newMetric(
+			metricSpec{
+				name: "gpu_process_memory_used",
+				unit: "bytes",
+				help: "gpu memory used by a process",
+			},
+			gpuProcessLabelList,
+		),
+		processes:  map[int]*gpuProcess{},
+		containers: map[processKey]string{},
+	}, nil
+}
+
+// labelValues returns the label values of a process record, the pid is
+// validated and its container resolved
+func (p *gpuProcesses) labelValues(gpu, pidField, name string) ([]string, int, error) {
+	pid, err := strconv.Atoi(pidField)
+	if err != nil || pid <= 0 {
+		return nil, 0, fmt.Errorf("invalid pid %q", pidField)
+	}
+	key := processKey{pid: pid, name: name}
+	container, ok := p.containers[key]
+	if !ok {
+		// failed reads are retried by the next record
+		if container, err = p.container(pid); err == nil {
+			p.containers[key] = container
+		}
+	}
+	return []string{gpu, pidField, name, container}, pid, nil
+}
+
+// container returns the container id of a process, empty if it doesn't
+// run in a container
+func (p *gpuProcesses) container(pid int) (string, error) {
+	f, err := os.Open(p.fs.Path(strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if ids := containerIDPattern.FindAllString(fields[2], -1); len(ids) > 0 {
+			return ids[len(ids)-1], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// set updates the series of a process, the series of a former process with
+// the same pid are removed
+func (p *gpuProcesses) set(pid int, lvs []string, v float64, ts time.Time) error {
+	if p.interval > 0 {
+		proc, ok := p.processes[pid]
+		if ok && proc.name != lvs[2] {
+			p.remove(pid, proc)
+			ok = false
+		}
+		if !ok {
+			proc = &gpuProcess{name: lvs[2]}
+			p.processes[pid] = proc
+		}
+		key := seriesKey(lvs)
+		known := false
+		for _, s := range proc.series {
+			if seriesKey(s) == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			proc.series = append(proc.series, lvs)
+		}
+		proc.updated = time.Now()
+	}
+	return p.metric.setAt(lvs, v, ts)
+}
+
+// removeExited removes the series of processes which had no record for the
+// interval and no longer exist
+func (p *gpuProcesses) removeExited(now time.Time) {
+	for pid, proc := range p.processes {
+		if now.Sub(proc.updated) < p.interval {
+			continue
+		}
+		_, err := p.fs.NewProc(pid)
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			log.Println("failed to check gpu process,", err)
+			continue
+		}
+		p.remove(pid, proc)
+	}
+}
+
+func (p *gpuProcesses) remove(pid int, proc *gpuProcess) {
+	for _, lvs := range proc.series {
+		p.metric.delete(lvs)
+	}
+	delete(p.processes, pid)
+	delete(p.containers, processKey{pid: pid, name: proc.name})
+}
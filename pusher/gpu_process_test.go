@@ -0,0 +1,113 @@
+package pusher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGpuProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "procfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	container := "3f1c1c4e8c5a2a0a6d1a9e4c7b2f8d0e5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d"
+	cgroups := map[string]string{
+		"100": "12:memory:/docker/" + container + "\n",
+		"200": "12:memory:/user.slice\n0::/user.slice/user-1000.slice\n",
+	}
+	for pid, cgroup := range cgroups {
+		if err := os.Mkdir(filepath.Join(dir, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, pid, "cgroup"), []byte(cgroup), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, err := NewGPUMeta("pushurl: http://127.0.0.1:9091\nprocfs: " + dir + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := p.(*gpu_meta)
+	for _, data := range []string{
+		"2017/09/18 00:28:08.188,16,0,100,python,512",
+		"2017/09/18 00:28:08.188,16,1,100,python,256",
+		"2017/09/18 00:28:08.188,16,0,200,train,1024",
+		"2017/09/18 00:28:08.188,16,0,abc,train,1024",
+		"2017/09/18 00:28:08.188,16,0,200,train",
+	} {
+		g.ParseAndPush(data)
+	}
+
+	cases := []struct {
+		labels   map[string]string
+		expected float64
+	}{
+		{map[string]string{"gpu": "0", "pid": "100", "process": "python", "container": container}, 512 << 20},
+		{map[string]string{"gpu": "1", "pid": "100", "container": container}, 256 << 20},
+		{map[string]string{"gpu": "0", "pid": "200", "process": "train", "container": ""}, 1024 << 20},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, "gpu_process_memory_used_bytes", c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+	if res, _ := gatheredValue(t, p, "hana_parse_errors_total", map[string]string{"reason": reasonMissingFields}); res != 1 {
+		t.Errorf("actual: %v, expected: %v", res, 1)
+	}
+
+	// pid 100 exits, pid 200 is running and pid 300 has no procfs entry but
+	// a recent record
+	g.ParseAndPush("2017/09/18 00:28:08.188,16,0,300,eval,64")
+	g.processes.processes[300].updated = time.Now().Add(time.Minute)
+	if err := os.RemoveAll(filepath.Join(dir, "100")); err != nil {
+		t.Fatal(err)
+	}
+	g.processes.removeExited(time.Now())
+	if _, ok := gatheredValue(t, p, "gpu_process_memory_used_bytes", map[string]string{"pid": "100"}); !ok {
+		t.Errorf("series of process 100 removed before processinterval")
+	}
+	g.processes.removeExited(time.Now().Add(time.Minute))
+	exists := map[string]bool{"100": false, "200": true, "300": true}
+	for pid, expected := range exists {
+		if _, ok := gatheredValue(t, p, "gpu_process_memory_used_bytes", map[string]string{"pid": pid}); ok != expected {
+			t.Errorf("pid %s, actual exists: %v, expected: %v", pid, ok, expected)
+		}
+	}
+
+	// pid 200 is reused by another process in the container
+	if err := ioutil.WriteFile(filepath.Join(dir, "200", "cgroup"), []byte(cgroups["100"]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g.ParseAndPush("2017/09/18 00:28:09.188,16,0,200,serve,128")
+	if _, ok := gatheredValue(t, p, "gpu_process_memory_used_bytes", map[string]string{"pid": "200", "process": "train"}); ok {
+		t.Errorf("series of former process 200 not removed")
+	}
+	labels := map[string]string{"pid": "200", "process": "serve", "container": container}
+	if _, ok := gatheredValue(t, p, "gpu_process_memory_used_bytes", labels); !ok {
+		t.Errorf("series of process 200 not attributed to the container")
+	}
+}
+
+func TestGpuProcessesUnchecked(t *testing.T) {
+	p, err := NewGPUMeta("pushurl: http://127.0.0.1:9091\nprocessinterval: 0s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := p.(*gpu_meta)
+	if g.housekeeping != nil {
+		t.Errorf("exited processes checked with processinterval 0")
+	}
+	g.ParseAndPush("2017/09/18 00:28:08.188,16,0,4194304,python,512")
+	if _, ok := gatheredValue(t, p, "gpu_process_memory_used_bytes", map[string]string{"pid": "4194304"}); !ok {
+		t.Errorf("series of process not exposed")
+	}
+	if _, err := NewGPUMeta("processinterval: -1s\n"); err == nil {
+		t.Errorf("actual: nil, expected: error for negative processinterval")
+	}
+}
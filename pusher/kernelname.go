@@ -0,0 +1,52 @@
+package pusher
+
+import (
+	"github.com/ksang/hana/demangle"
+	"github.com/olebedev/config"
+)
+
+// kernelNames turns mangled asaka kernel symbols into label values:
+//
+//	demangle:        replace the name label by the demangled C++ name
+//	demanglelabels:  add kernel_base and kernel_namespace labels, e.g. to sum
+//	                 all template instances of a kernel
+//
+// Names which can't be demangled are kept raw, with the raw name as base.
+type kernelNames struct {
+	demangle bool
+	labels   bool
+}
+
+func newKernelNames(cfg *config.Config) *kernelNames {
+	return &kernelNames{
+		demangle: cfg.UBool("demangle", false),
+		labels:   cfg.UBool("demanglelabels", false),
+	}
+}
+
+// labelNames are the label names of kernel metrics
+func (k *kernelNames) labelNames() []string {
+	if !k.labels {
+		return kernelLabelList
+	}
+	return append(append([]string(nil), kernelLabelList...), "kernel_base", "kernel_namespace")
+}
+
+// labelValues returns the values of the kernel name labels following
+// session and client_id
+func (k *kernelNames) labelValues(raw string) []string {
+	if !k.demangle && !k.labels {
+		return []string{raw}
+	}
+	name, base, namespace := raw, raw, ""
+	if sym, err := demangle.Demangle(raw); err == nil {
+		base, namespace = sym.Base, sym.Namespace
+		if k.demangle {
+			name = sym.Name
+		}
+	}
+	if !k.labels {
+		return []string{name}
+	}
+	return []string{name, base, namespace}
+}
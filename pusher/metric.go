@@ -0,0 +1,531 @@
+package pusher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	metricTypeGauge   = "gauge"
+	metricTypeCounter = "counter"
+	// histograms and summaries observe values derived by the pusher, they
+	// can't be declared by config
+	metricTypeHistogram = "histogram"
+	metricTypeSummary   = "summary"
+
+	// accumulationDelta adds the value of each line to the counter
+	accumulationDelta = "delta"
+	// accumulationCumulative adds the increase since the last raw value of
+	// the series, a decrease is taken as reset and the raw value is added
+	accumulationCumulative = "cumulative"
+)
+
+// metricSpec declares a metric of a config driven pusher:
+//
+//	name: metric name
+//	help: help text, defaults to the name
+//	type: "gauge" sets the value, "counter" adds the value, default gauge
+//	unit: unit appended to the name as suffix, e.g. "bytes"
+//	accumulation: how values are added to a counter, "delta" (default) or "cumulative"
+type metricSpec struct {
+	name         string
+	help         string
+	typ          string
+	unit         string
+	accumulation string
+}
+
+func parseMetricSpec(m map[string]interface{}) (metricSpec, error) {
+	spec := metricSpec{
+		name: stringValue(m["name"]),
+		help: stringValue(m["help"]),
+		typ:  strings.ToLower(stringValue(m["type"])),
+		unit: stringValue(m["unit"]),
+
+		accumulation: strings.ToLower(stringValue(m["accumulation"])),
+	}
+	if len(spec.name) == 0 {
+		return spec, fmt.Errorf("metric name is missing")
+	}
+	if len(spec.help) == 0 {
+		spec.help = spec.name
+	}
+	switch spec.typ {
+	case "":
+		spec.typ = metricTypeGauge
+	case metricTypeGauge, metricTypeCounter:
+	default:
+		return spec, fmt.Errorf("unknown type %q of metric %s", spec.typ, spec.name)
+	}
+	switch {
+	case spec.typ != metricTypeCounter && len(spec.accumulation) > 0:
+		return spec, fmt.Errorf("accumulation of metric %s requires type counter", spec.name)
+	case spec.typ == metricTypeCounter && len(spec.accumulation) == 0:
+		spec.accumulation = accumulationDelta
+	case spec.typ == metricTypeCounter &&
+		spec.accumulation != accumulationDelta && spec.accumulation != accumulationCumulative:
+		return spec, fmt.Errorf("unknown accumulation %q of metric %s", spec.accumulation, spec.name)
+	}
+	if !model.IsValidMetricName(model.LabelValue(spec.fqName())) {
+		return spec, fmt.Errorf("invalid metric name %q", spec.fqName())
+	}
+	return spec, nil
+}
+
+// checkLabelNames rejects invalid, reserved and duplicate label names, the
+// pipeline label is added by the pipeline gatherer
+func checkLabelNames(labelNames []string) error {
+	seen := map[string]bool{}
+	for _, name := range labelNames {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) ||
+			name == PipelineLabel {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate label name %s", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// fqName is the metric name with unit suffix
+func (s metricSpec) fqName() string {
+	if len(s.unit) == 0 || strings.HasSuffix(s.name, "_"+s.unit) {
+		return s.name
+	}
+	return s.name + "_" + s.unit
+}
+
+// metric is a gauge, counter, histogram or summary vector declared by a
+// metricSpec, series can carry the explicit timestamp of their last sample
+// and expire when they received no sample for ttl
+type metric struct {
+	spec       metricSpec
+	labelNames []string
+	gauge      *prometheus.GaugeVec
+	counter    *prometheus.CounterVec
+	// observer is the vector of histograms or summaries
+	observer *prometheus.MetricVec
+
+	ttl time.Duration
+	// ended exposes the last update time of expired series for another ttl
+	ended *prometheus.GaugeVec
+
+	// maxSeries limits the number of series, samples of new series beyond
+	// the limit go to the overflow series or are dropped, samples of
+	// cumulative counters and observers are always dropped
+	maxSeries    int
+	overflowDrop bool
+	rejected     prometheus.Counter
+
+	// updateMu serializes updates of the series and their vectors, mu guards
+	// series and endedAt, which Collect reads. Vector operations never run
+	// under mu, as collecting a vector holds its lock while the collected
+	// metrics are written.
+	updateMu sync.Mutex
+	mu       sync.Mutex
+	series   map[string]*seriesState
+	// endedAt holds the expiry time of series exposed by ended
+	endedAt map[string]*seriesState
+}
+
+// seriesState is the state kept per series of a metric
+type seriesState struct {
+	lvs []string
+	// timestamp of the last sample in milliseconds, 0 if not exposed
+	timestamp int64
+	// last raw value of cumulative counters
+	last float64
+	// raw values of the last line of observers
+	raw []float64
+	// updated is the time of the last sample
+	updated time.Time
+}
+
+func newMetric(spec metricSpec, labelNames []string) *metric {
+	m := &metric{
+		spec:       spec,
+		labelNames: labelNames,
+		series:     map[string]*seriesState{},
+		endedAt:    map[string]*seriesState{},
+	}
+	switch spec.typ {
+	case metricTypeCounter:
+		m.counter = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: spec.fqName(),
+				Help: spec.help,
+			},
+			labelNames,
+		)
+	default:
+		m.gauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: spec.fqName(),
+				Help: spec.help,
+			},
+			labelNames,
+		)
+	}
+	return m
+}
+
+// newObserverMetric creates a histogram or summary metric of vec, which must
+// have labelNames
+func newObserverMetric(spec metricSpec, labelNames []string, vec *prometheus.MetricVec) *metric {
+	return &metric{
+		spec:       spec,
+		labelNames: labelNames,
+		observer:   vec,
+		series:     map[string]*seriesState{},
+		endedAt:    map[string]*seriesState{},
+	}
+}
+
+// setTTL makes series expire after ttl without samples, an ended series is
+// exposed by <name>_ended_timestamp_seconds for another ttl if endedInfo
+func (m *metric) setTTL(ttl time.Duration, endedInfo bool) {
+	m.ttl = ttl
+	if ttl > 0 && endedInfo {
+		m.ended = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: m.spec.fqName() + "_ended_timestamp_seconds",
+				Help: "last update time of expired " + m.spec.fqName() + " series",
+			},
+			m.labelNames,
+		)
+	}
+}
+
+// setLimit limits the number of series to maxSeries, 0 is unlimited, samples
+// of rejected series are counted by rejected
+func (m *metric) setLimit(maxSeries int, drop bool, rejected prometheus.Counter) {
+	m.maxSeries = maxSeries
+	m.overflowDrop = drop
+	m.rejected = rejected
+}
+
+// overflowValue is the value of all labels of the overflow series
+const overflowValue = "__overflow__"
+
+func overflowLabels(n int) []string {
+	lvs := make([]string, n)
+	for i := range lvs {
+		lvs[i] = overflowValue
+	}
+	return lvs
+}
+
+// full checks whether no new series is allowed, the overflow series doesn't
+// count to the limit
+func (m *metric) full() bool {
+	if m.maxSeries <= 0 {
+		return false
+	}
+	n := len(m.series)
+	if _, ok := m.series[seriesKey(overflowLabels(len(m.labelNames)))]; ok {
+		n--
+	}
+	return n >= m.maxSeries
+}
+
+func (m *metric) collector() prometheus.Collector {
+	return m
+}
+
+func (m *metric) vec() prometheus.Collector {
+	switch {
+	case m.counter != nil:
+		return m.counter
+	case m.observer != nil:
+		return m.observer
+	}
+	return m.gauge
+}
+
+// deleteSeries removes the series of label values from the vector
+func (m *metric) deleteSeries(lvs []string) {
+	switch {
+	case m.counter != nil:
+		m.counter.DeleteLabelValues(lvs...)
+	case m.observer != nil:
+		m.observer.DeleteLabelValues(lvs...)
+	default:
+		m.gauge.DeleteLabelValues(lvs...)
+	}
+}
+
+func (m *metric) Describe(ch chan<- *prometheus.Desc) {
+	m.vec().Describe(ch)
+	if m.ended != nil {
+		m.ended.Describe(ch)
+	}
+}
+
+func (m *metric) Collect(ch chan<- prometheus.Metric) {
+	timestamps := map[string]int64{}
+	m.mu.Lock()
+	for key, state := range m.series {
+		if state.timestamp != 0 {
+			timestamps[key] = state.timestamp
+		}
+	}
+	m.mu.Unlock()
+	if len(timestamps) == 0 {
+		m.vec().Collect(ch)
+	} else {
+		inner := make(chan prometheus.Metric)
+		go func() {
+			m.vec().Collect(inner)
+			close(inner)
+		}()
+		for pm := range inner {
+			ch <- &timestampedMetric{Metric: pm, labelNames: m.labelNames, timestamps: timestamps}
+		}
+	}
+	if m.ended != nil {
+		m.ended.Collect(ch)
+	}
+}
+
+// seriesKey identifies a series of m by its label values
+func seriesKey(lvs []string) string {
+	return strings.Join(lvs, "\xff")
+}
+
+// timestampedMetric sets the timestamp of its series when written,
+// timestamps are the timestamps of the series by key when collected
+type timestampedMetric struct {
+	prometheus.Metric
+	labelNames []string
+	timestamps map[string]int64
+}
+
+func (t *timestampedMetric) Write(out *dto.Metric) error {
+	if err := t.Metric.Write(out); err != nil {
+		return err
+	}
+	values := map[string]string{}
+	for _, lp := range out.Label {
+		values[lp.GetName()] = lp.GetValue()
+	}
+	lvs := make([]string, len(t.labelNames))
+	for i, name := range t.labelNames {
+		lvs[i] = values[name]
+	}
+	if ts, ok := t.timestamps[seriesKey(lvs)]; ok {
+		out.TimestampMs = proto.Int64(ts)
+	}
+	return nil
+}
+
+// expire removes series without samples for ttl and returns their count
+func (m *metric) expire(now time.Time) int {
+	if m.ttl <= 0 {
+		return 0
+	}
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+	var ended, expired []*seriesState
+	m.mu.Lock()
+	for key, state := range m.endedAt {
+		if now.Sub(state.updated) > m.ttl {
+			ended = append(ended, state)
+			delete(m.endedAt, key)
+		}
+	}
+	for key, state := range m.series {
+		if now.Sub(state.updated) <= m.ttl {
+			continue
+		}
+		expired = append(expired, state)
+		delete(m.series, key)
+		if m.ended != nil {
+			m.endedAt[key] = &seriesState{lvs: state.lvs, updated: now}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, state := range ended {
+		m.ended.DeleteLabelValues(state.lvs...)
+	}
+	for _, state := range expired {
+		m.deleteSeries(state.lvs)
+		if m.ended != nil {
+			m.ended.WithLabelValues(state.lvs...).Set(float64(state.updated.UnixNano()) / 1e9)
+		}
+	}
+	return len(expired)
+}
+
+// delete removes the series of label values
+func (m *metric) delete(lvs []string) {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+	m.mu.Lock()
+	delete(m.series, seriesKey(lvs))
+	m.mu.Unlock()
+	m.deleteSeries(lvs)
+}
+
+// compatible checks whether m can be shared by another declaration
+func (m *metric) compatible(spec metricSpec, labelNames []string) bool {
+	if m.spec != spec || len(m.labelNames) != len(labelNames) {
+		return false
+	}
+	for i := range labelNames {
+		if m.labelNames[i] != labelNames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// declareMetric returns the metric of spec from metrics, creating it if it is
+// not declared yet, metrics declared several times must be compatible
+func declareMetric(metrics map[string]*metric, spec metricSpec, labelNames []string) (*metric, error) {
+	if err := checkLabelNames(labelNames); err != nil {
+		return nil, fmt.Errorf("metric %s: %v", spec.fqName(), err)
+	}
+	m, ok := metrics[spec.fqName()]
+	if !ok {
+		m = newMetric(spec, labelNames)
+		metrics[spec.fqName()] = m
+	} else if !m.compatible(spec, labelNames) {
+		return nil, fmt.Errorf("metric %s is declared differently elsewhere", spec.fqName())
+	}
+	return m, nil
+}
+
+// set updates the series of label values with v
+func (m *metric) set(lvs []string, v float64) error {
+	return m.setAt(lvs, v, time.Time{})
+}
+
+// setAt updates the series of label values with v sampled at ts, the series
+// is exposed without timestamp if ts is zero
+func (m *metric) setAt(lvs []string, v float64, ts time.Time) error {
+	if m.counter != nil && v < 0 {
+		return fmt.Errorf("negative value %f for counter %s", v, m.spec.fqName())
+	}
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+	m.mu.Lock()
+	state, seen := m.track(lvs)
+	if state == nil {
+		m.mu.Unlock()
+		return nil
+	}
+	if m.counter != nil && m.spec.accumulation == accumulationCumulative {
+		last := state.last
+		state.last = v
+		if seen && v >= last {
+			v -= last
+		}
+	}
+	revived := m.touch(state, ts)
+	m.mu.Unlock()
+
+	m.revive(state, revived)
+	if m.counter != nil {
+		m.counter.WithLabelValues(state.lvs...).Add(v)
+	} else {
+		m.gauge.WithLabelValues(state.lvs...).Set(v)
+	}
+	return nil
+}
+
+// observation is implemented by the histograms and summaries of observers
+type observation interface {
+	Observe(float64)
+}
+
+// observe keeps the raw values of a line in its series and observes the value
+// derive returns from the raw values of the last line and raw, nothing is
+// observed for the first line of a series or if derive returns false
+func (m *metric) observe(lvs []string, raw []float64, derive func(last, raw []float64) (float64, bool)) {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+	m.mu.Lock()
+	state, seen := m.track(lvs)
+	if state == nil {
+		m.mu.Unlock()
+		return
+	}
+	last := state.raw
+	state.raw = raw
+	revived := m.touch(state, time.Time{})
+	m.mu.Unlock()
+
+	m.revive(state, revived)
+	if !seen {
+		return
+	}
+	if v, ok := derive(last, raw); ok {
+		m.observer.WithLabelValues(state.lvs...).(observation).Observe(v)
+	}
+}
+
+// track returns the state of the series of label values, it is created if
+// the series limit allows, otherwise the overflow series is returned, or nil
+// if the sample is dropped. seen reports whether the series existed. mu must
+// be held.
+func (m *metric) track(lvs []string) (state *seriesState, seen bool) {
+	key := seriesKey(lvs)
+	state, seen = m.series[key]
+	if !seen && m.full() {
+		m.rejected.Inc()
+		// the increase of cumulative values needs the last values of their
+		// own series, which aren't kept for series beyond the limit
+		if m.overflowDrop || m.spec.accumulation == accumulationCumulative || m.observer != nil {
+			return nil, false
+		}
+		lvs = overflowLabels(len(lvs))
+		key = seriesKey(lvs)
+		state, seen = m.series[key]
+	}
+	if !seen {
+		state = &seriesState{lvs: append([]string(nil), lvs...)}
+		m.series[key] = state
+	}
+	return state, seen
+}
+
+// touch records a sample of a series at ts, mu must be held. It reports
+// whether the series had ended, revive must be called after mu is released.
+func (m *metric) touch(state *seriesState, ts time.Time) bool {
+	state.timestamp = 0
+	if !ts.IsZero() {
+		state.timestamp = ts.UnixNano() / int64(time.Millisecond)
+	}
+	state.updated = time.Now()
+	key := seriesKey(state.lvs)
+	if _, ok := m.endedAt[key]; ok {
+		delete(m.endedAt, key)
+		return true
+	}
+	return false
+}
+
+// revive removes the ended series of a series touched again
+func (m *metric) revive(state *seriesState, ended bool) {
+	if ended {
+		m.ended.DeleteLabelValues(state.lvs...)
+	}
+}
+
+// stringValue converts a scalar config value to string
+func stringValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
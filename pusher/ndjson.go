@@ -0,0 +1,304 @@
+package pusher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reasons of hana_json_errors_total
+const (
+	jsonErrInvalid      = "invalid_json"
+	jsonErrMissingField = "missing_field"
+	jsonErrTypeMismatch = "type_mismatch"
+)
+
+type ndjsonValue struct {
+	field  string
+	metric *metric
+}
+
+// ndjson is a pusher decoding every line as a JSON document, labels and values
+// are extracted by dotted field paths, e.g. "device.0.index":
+//
+//	samples: kernels          optional path of an array of samples
+//	timestamp: ts             optional path of the sample time
+//	timestampformat: unix     unix, unix_ms, rfc3339 (default) or a Go time layout
+//	labels:
+//	  session: session.id
+//	metrics:
+//	  - field: stats.runtime
+//	    name: kernel_running_time
+//
+// When samples is configured, paths are resolved in each sample first and
+// then in the document. A line with invalid samples is rejected once, its
+// valid samples are still pushed.
+type ndjson struct {
+	*base
+
+	samples         string
+	timestamp       string
+	timestampFormat string
+	labelNames      []string
+	labelFields     []string
+	values          []ndjsonValue
+	errorMetric     *prometheus.CounterVec
+}
+
+func NewJSON(conf string) (Pusher, error) {
+	cfg, err := config.ParseYaml(conf)
+	if err != nil {
+		return nil, err
+	}
+	n := &ndjson{
+		samples:         cfg.UString("samples"),
+		timestamp:       cfg.UString("timestamp"),
+		timestampFormat: cfg.UString("timestampformat", "rfc3339"),
+		errorMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_json_errors_total",
+				Help: "json lines failed to decode or extract",
+			},
+			[]string{"reason"},
+		),
+	}
+	labels := cfg.UMap("labels")
+	for name := range labels {
+		n.labelNames = append(n.labelNames, name)
+	}
+	sort.Strings(n.labelNames)
+	for _, name := range n.labelNames {
+		n.labelFields = append(n.labelFields, stringValue(labels[name]))
+	}
+	metrics := map[string]*metric{}
+	values, err := cfg.List("metrics")
+	if err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("metrics are not configured")
+	}
+	for _, v := range values {
+		mdecl, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("metric must be a map")
+		}
+		spec, err := parseMetricSpec(mdecl)
+		if err != nil {
+			return nil, err
+		}
+		field := stringValue(mdecl["field"])
+		if len(field) == 0 {
+			return nil, fmt.Errorf("metric %s field is missing", spec.name)
+		}
+		m, err := declareMetric(metrics, spec, n.labelNames)
+		if err != nil {
+			return nil, err
+		}
+		n.values = append(n.values, ndjsonValue{field: field, metric: m})
+	}
+
+	n.base, err = newBase(cfg, n.ParseAndPush)
+	if err != nil {
+		return nil, err
+	}
+	// Metrics have to be registered to be exposed:
+	n.registry.MustRegister(n.errorMetric)
+	for _, m := range metrics {
+		if err := n.registerMetrics(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := n.checkMetricNames(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *ndjson) ParseAndPush(data string) {
+	if len(strings.TrimSpace(data)) == 0 {
+		// ignore
+		return
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		n.reject(data, jsonErrInvalid, err)
+		return
+	}
+	if len(n.samples) == 0 {
+		if reason, err := n.push(doc, nil); err != nil {
+			n.reject(data, reason, err)
+		}
+		return
+	}
+	v, ok := lookupPath(doc, n.samples)
+	if !ok {
+		n.reject(data, jsonErrMissingField, fmt.Errorf("samples %s not found", n.samples))
+		return
+	}
+	samples, ok := v.([]interface{})
+	if !ok {
+		n.reject(data, jsonErrTypeMismatch, fmt.Errorf("samples %s is not an array", n.samples))
+		return
+	}
+	// valid samples are pushed, a line with invalid samples is rejected
+	// once with the reason of its first invalid sample
+	var (
+		reason string
+		errs   []string
+	)
+	for idx, sample := range samples {
+		r, err := n.push(doc, sample)
+		if err == nil {
+			continue
+		}
+		if len(errs) == 0 {
+			reason = r
+		}
+		errs = append(errs, fmt.Sprintf("sample #%d: %v", idx+1, err))
+	}
+	if len(errs) > 0 {
+		n.reject(data, reason, errors.New(strings.Join(errs, "; ")))
+	}
+}
+
+// reject counts a line by hana_json_errors_total and hana_parse_errors_total
+// and keeps it in the dead-letter file
+func (n *ndjson) reject(data, reason string, err error) {
+	n.errorMetric.WithLabelValues(reason).Inc()
+	n.parseError(data, reason, err)
+}
+
+// lookup resolves path in sample first and then in doc
+func (n *ndjson) lookup(doc, sample interface{}, path string) (interface{}, error) {
+	if sample != nil {
+		if v, ok := lookupPath(sample, path); ok {
+			return v, nil
+		}
+	}
+	if v, ok := lookupPath(doc, path); ok {
+		return v, nil
+	}
+	return nil, fmt.Errorf("field %s not found", path)
+}
+
+// push sets the metrics of a sample, it returns the reason and error of an
+// invalid sample
+func (n *ndjson) push(doc, sample interface{}) (string, error) {
+	lvs := make([]string, len(n.labelFields))
+	for i, field := range n.labelFields {
+		v, err := n.lookup(doc, sample, field)
+		if err != nil {
+			return jsonErrMissingField, err
+		}
+		if lvs[i], err = labelValue(v); err != nil {
+			return jsonErrTypeMismatch, fmt.Errorf("field %s: %v", field, err)
+		}
+	}
+	values := make([]float64, len(n.values))
+	for i, value := range n.values {
+		v, err := n.lookup(doc, sample, value.field)
+		if err != nil {
+			return jsonErrMissingField, err
+		}
+		if values[i], err = numberValue(v); err != nil {
+			return jsonErrTypeMismatch, fmt.Errorf("field %s: %v", value.field, err)
+		}
+	}
+	var ts time.Time
+	if len(n.timestamp) > 0 {
+		v, err := n.lookup(doc, sample, n.timestamp)
+		if err != nil {
+			return jsonErrMissingField, err
+		}
+		if ts, err = timeValue(v, n.timestampFormat); err != nil {
+			return jsonErrTypeMismatch, fmt.Errorf("field %s: %v", n.timestamp, err)
+		}
+	}
+
+	if n.logParsed {
+		log.Printf("data parsed: LABELS: %v VALUES: %v TIME: %v", lvs, values, ts)
+		return "", nil
+	}
+	for i, value := range n.values {
+		if err := value.metric.setAt(lvs, values[i], ts); err != nil {
+			log.Println(err)
+		}
+	}
+	return "", nil
+}
+
+// lookupPath resolves a dotted path of object keys and array indexes
+func lookupPath(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return nil, false
+			}
+			v = node[idx]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func labelValue(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", fmt.Errorf("scalar expected, got %T", v)
+}
+
+func numberValue(v interface{}) (float64, error) {
+	switch value := v.(type) {
+	case float64:
+		return value, nil
+	case int:
+		return float64(value), nil
+	case string:
+		return strconv.ParseFloat(value, 64)
+	}
+	return 0, fmt.Errorf("number expected, got %T", v)
+}
+
+func timeValue(v interface{}, format string) (time.Time, error) {
+	switch format {
+	case "unix", "unix_ms":
+		sec, err := numberValue(v)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if format == "unix_ms" {
+			sec /= 1000
+		}
+		whole, frac := math.Modf(sec)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	case "rfc3339":
+		format = time.RFC3339Nano
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("time string expected, got %T", v)
+	}
+	return time.Parse(format, s)
+}
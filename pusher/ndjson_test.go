@@ -0,0 +1,102 @@
+package pusher
+
+import (
+	"testing"
+)
+
+var (
+	json_monitor_data = []string{
+		`{"ts": 1504171516.5, "session": {"id": 3}, "kernels": [` +
+			`{"name": "_Z13FFT512_deviceI6float2fEvPT_", "stats": {"runtime": 130, "calls": "10"}},` +
+			`{"name": "_Z14IFFT512_deviceI6float2fEvPT_", "stats": {"runtime": 106, "calls": 10}}]}`,
+		`not json`,
+		`{"ts": 1504171517, "session": {"id": 3}, "kernels": [{"name": "k", "stats": {"runtime": true, "calls": 1}}]}`,
+		`{"ts": 1504171517, "session": {"id": 3}, "kernels": [{"name": "k", "stats": {"calls": 1}}]}`,
+		`{"ts": 1504171517, "session": {"id": 3}, "kernels": {"name": "k"}}`,
+		`{"ts": 1504171516.5, "session": {"id": 4}, "kernels": [{"name": "a", "stats": {"calls": 1}},` +
+			`{"name": "b", "stats": {"runtime": "x", "calls": 1}}, {"name": "c", "stats": {"runtime": 5, "calls": 1}}]}`,
+	}
+	json_conf = `pushurl: http://127.0.0.1:9091
+samples: kernels
+timestamp: ts
+timestampformat: unix
+labels:
+  session: session.id
+  name: name
+metrics:
+  - field: stats.runtime
+    name: kernel_running_time
+    help: kernel total running time
+  - field: stats.calls
+    name: kernel_call_count
+    help: kernel total call count
+`
+)
+
+func TestLookupPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{"b": []interface{}{1.0, map[string]interface{}{"c": "x"}}},
+	}
+	cases := []struct {
+		path     string
+		expected interface{}
+		ok       bool
+	}{
+		{"a.b.0", 1.0, true},
+		{"a.b.1.c", "x", true},
+		{"a.b.2", nil, false},
+		{"a.c", nil, false},
+		{"a.b.0.c", nil, false},
+	}
+	for idx, c := range cases {
+		res, ok := lookupPath(doc, c.path)
+		if ok != c.ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v %v, expected: %v %v", idx+1, res, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func TestJSONPusher(t *testing.T) {
+	p, err := NewJSON(json_conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range json_monitor_data {
+		p.(*ndjson).ParseAndPush(data)
+	}
+
+	cases := []struct {
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{"kernel_running_time", map[string]string{"session": "3", "name": "_Z13FFT512_deviceI6float2fEvPT_"}, 130},
+		{"kernel_call_count", map[string]string{"name": "_Z14IFFT512_deviceI6float2fEvPT_"}, 10},
+		{"hana_json_errors_total", map[string]string{"reason": jsonErrInvalid}, 1},
+		{"hana_json_errors_total", map[string]string{"reason": jsonErrTypeMismatch}, 2},
+		{"kernel_running_time", map[string]string{"session": "4", "name": "c"}, 5},
+		{"hana_json_errors_total", map[string]string{"reason": jsonErrMissingField}, 2},
+		{"hana_parse_errors_total", map[string]string{"reason": jsonErrMissingField}, 2},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+
+	mfs, err := p.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "kernel_running_time" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			if m.GetTimestampMs() != 1504171516500 {
+				t.Errorf("actual timestamp: %v, expected: 1504171516500", m.GetTimestampMs())
+			}
+		}
+	}
+}
@@ -3,10 +3,45 @@ Package pusher provides functionality for parsing and pushing metrics to prometh
 */
 package pusher
 
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
 // Pusher is the common interface defining how to consume data from a datasource
 type Pusher interface {
-	// Start a new pusher and by providing a datasource channel
-	Start(chan string) error
-	// Stop the pusher
+	// Start parsing the lines of the datasource channel until ctx is done,
+	// Stop is called or the channel is closed, the pusher performs its final
+	// push when it ends
+	Start(ctx context.Context, src <-chan string) error
+	// Stop the pusher and wait until it ended, Stop is idempotent and returns
+	// the error ending the pusher
 	Stop() error
+	// Done is closed when the pusher ended, after all lines of a closed
+	// datasource channel are parsed
+	Done() <-chan struct{}
+	// Errors receives errors which don't end the pusher, it is closed when
+	// the pusher ended
+	Errors() <-chan error
+	// Gatherer returns the metrics of the pusher, labelled by its pipeline
+	Gatherer() prometheus.Gatherer
+}
+
+// PushGroup is implemented by pushers which can push to a Pushgateway group
+type PushGroup interface {
+	// PushGroupURL returns the url of the Pushgateway group, it is empty
+	// without pushurl
+	PushGroupURL() string
+	// KeepPushGroup makes the pusher skip deleting its group when it stops,
+	// for a replacement pushing to the same group
+	KeepPushGroup()
+}
+
+// LineParser is implemented by pushers which can parse lines without a
+// datasource, to try configs offline
+type LineParser interface {
+	// ParseLine parses a line and returns its error, it must not be called
+	// after Start
+	ParseLine(line string) error
 }
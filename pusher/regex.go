@@ -0,0 +1,277 @@
+package pusher
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// grokPatterns is the builtin library of named patterns usable as %{NAME}
+var grokPatterns = map[string]string{
+	"INT":          `[+-]?[0-9]+`,
+	"BASE10NUM":    `[+-]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][+-]?[0-9]+)?`,
+	"NUMBER":       `%{BASE10NUM}`,
+	"BASE16NUM":    `(?:0[xX])?[0-9A-Fa-f]+`,
+	"WORD":         `\w+`,
+	"NOTSPACE":     `\S+`,
+	"SPACE":        `\s*`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `"(?:[^"\\]|\\.)*"`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"IPV4":         `(?:[0-9]{1,3}\.){3}[0-9]{1,3}`,
+	"HOSTNAME":     `[0-9A-Za-z][0-9A-Za-z-]*(?:\.[0-9A-Za-z][0-9A-Za-z-]*)*`,
+	"YEAR":         `[0-9]{4}`,
+	"DATE":         `%{YEAR}[/-][0-9]{2}[/-][0-9]{2}`,
+	"TIME":         `[0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)?`,
+	"TIMESTAMP":    `%{DATE}[ T]%{TIME}`,
+}
+
+// grokReference matches %{NAME} and %{NAME:capture}
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+// handling of lines matching no rule
+const (
+	unmatchedIgnore     = "ignore"
+	unmatchedCount      = "count"
+	unmatchedDeadLetter = "deadletter"
+)
+
+// maxGrokDepth limits the nesting of pattern references
+const maxGrokDepth = 16
+
+// regexRule turns the named captures of a pattern into labels and metrics
+type regexRule struct {
+	pattern      *regexp.Regexp
+	labelNames   []string
+	labelIndexes []int
+	values       []regexValue
+}
+
+type regexValue struct {
+	index  int
+	metric *metric
+}
+
+// regex is a pusher applying regular expressions with named captures to
+// unstructured lines, the first matching rule is used:
+//
+//	patterns:
+//	  KERNEL: '_Z\w+'
+//	rules:
+//	  - match: '^%{INT},2,%{INT:session},%{INT},%{NOTSPACE},%{KERNEL:name},%{INT:runtime}'
+//	    labels: [session, name]
+//	    metrics:
+//	      - value: runtime
+//	        name: asaka_kernel_running_time
+//	        help: kernel total running time
+//	unmatched: "ignore" (default), "count" or "deadletter"
+//
+// Lines matching no rule are counted by hana_regex_unmatched_lines_total,
+// with "count" they are also rejected by hana_parse_errors_total, with
+// "deadletter" they are logged and written to the dead-letter file as well.
+// Empty lines are skipped.
+type regex struct {
+	*base
+
+	rules           []*regexRule
+	unmatched       string
+	unmatchedMetric prometheus.Counter
+}
+
+func NewRegex(conf string) (Pusher, error) {
+	cfg, err := config.ParseYaml(conf)
+	if err != nil {
+		return nil, err
+	}
+	patterns := map[string]string{}
+	for name, p := range grokPatterns {
+		patterns[name] = p
+	}
+	for name, p := range cfg.UMap("patterns") {
+		patterns[name] = stringValue(p)
+	}
+	rules, err := cfg.List("rules")
+	if err != nil || len(rules) == 0 {
+		return nil, fmt.Errorf("rules are not configured")
+	}
+	unmatched := strings.ToLower(cfg.UString("unmatched", unmatchedIgnore))
+	switch unmatched {
+	case unmatchedIgnore, unmatchedCount, unmatchedDeadLetter:
+	default:
+		return nil, fmt.Errorf("unknown unmatched %q", unmatched)
+	}
+	r := &regex{
+		unmatched: unmatched,
+		unmatchedMetric: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "hana_regex_unmatched_lines_total",
+				Help: "lines matching no regex rule",
+			},
+		),
+	}
+	metrics := map[string]*metric{}
+	for idx, v := range rules {
+		rule, err := parseRegexRule(v, patterns, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %v", idx+1, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+
+	r.base, err = newBase(cfg, r.ParseAndPush)
+	if err != nil {
+		return nil, err
+	}
+	// Metrics have to be registered to be exposed:
+	r.registry.MustRegister(r.unmatchedMetric)
+	for _, m := range metrics {
+		if err := r.registerMetrics(m); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.checkMetricNames(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// expandGrok replaces pattern references with their regular expressions,
+// references with a capture name become named groups
+func expandGrok(expr string, patterns map[string]string) (string, error) {
+	var err error
+	for depth := 0; grokReference.MatchString(expr); depth++ {
+		if depth == maxGrokDepth {
+			return "", fmt.Errorf("pattern references nested too deep")
+		}
+		expr = grokReference.ReplaceAllStringFunc(expr, func(ref string) string {
+			sub := grokReference.FindStringSubmatch(ref)
+			p, ok := patterns[sub[1]]
+			if !ok {
+				err = fmt.Errorf("unknown pattern %s", sub[1])
+				return ""
+			}
+			if len(sub[2]) > 0 {
+				return "(?P<" + sub[2] + ">" + p + ")"
+			}
+			return "(?:" + p + ")"
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return expr, nil
+}
+
+func parseRegexRule(v interface{}, patterns map[string]string, metrics map[string]*metric) (*regexRule, error) {
+	decl, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("rule must be a map")
+	}
+	expr, err := expandGrok(stringValue(decl["match"]), patterns)
+	if err != nil {
+		return nil, err
+	}
+	if len(expr) == 0 {
+		return nil, fmt.Errorf("match is missing")
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	rule := &regexRule{pattern: pattern}
+	captureIndex := func(name string) (int, error) {
+		idx := pattern.SubexpIndex(name)
+		if idx < 0 {
+			return 0, fmt.Errorf("no capture named %s", name)
+		}
+		return idx, nil
+	}
+
+	labels, _ := decl["labels"].([]interface{})
+	for _, l := range labels {
+		name := stringValue(l)
+		idx, err := captureIndex(name)
+		if err != nil {
+			return nil, err
+		}
+		rule.labelNames = append(rule.labelNames, name)
+		rule.labelIndexes = append(rule.labelIndexes, idx)
+	}
+	values, _ := decl["metrics"].([]interface{})
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no metrics declared")
+	}
+	for _, v := range values {
+		mdecl, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("metric must be a map")
+		}
+		spec, err := parseMetricSpec(mdecl)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := captureIndex(stringValue(mdecl["value"]))
+		if err != nil {
+			return nil, fmt.Errorf("metric %s value: %v", spec.name, err)
+		}
+		m, err := declareMetric(metrics, spec, rule.labelNames)
+		if err != nil {
+			return nil, err
+		}
+		rule.values = append(rule.values, regexValue{index: idx, metric: m})
+	}
+	return rule, nil
+}
+
+func (r *regex) ParseAndPush(data string) {
+	if len(strings.TrimSpace(data)) == 0 {
+		return
+	}
+	for _, rule := range r.rules {
+		match := rule.pattern.FindStringSubmatch(data)
+		if match == nil {
+			continue
+		}
+		r.push(data, rule, match)
+		return
+	}
+	r.unmatchedMetric.Inc()
+	switch r.unmatched {
+	case unmatchedCount:
+		r.countParseError(reasonUnmatched, fmt.Errorf("no pattern matched"))
+	case unmatchedDeadLetter:
+		r.parseError(data, reasonUnmatched, fmt.Errorf("no pattern matched"))
+	}
+}
+
+func (r *regex) push(data string, rule *regexRule, match []string) {
+	lvs := make([]string, len(rule.labelIndexes))
+	for i, idx := range rule.labelIndexes {
+		lvs[i] = match[idx]
+	}
+	values := make([]float64, len(rule.values))
+	for i, v := range rule.values {
+		var err error
+		values[i], err = strconv.ParseFloat(match[v.index], 64)
+		if err != nil {
+			r.parseError(data, reasonInvalidNumber, fmt.Errorf("metric %s: %v", v.metric.spec.fqName(), err))
+			return
+		}
+	}
+
+	if r.logParsed {
+		log.Printf("data parsed: PATTERN: %s LABELS: %v VALUES: %v", rule.pattern, lvs, values)
+		return
+	}
+	for i, v := range rule.values {
+		if err := v.metric.set(lvs, values[i]); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package pusher
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	regex_conf = `pushurl: http://127.0.0.1:9091
+patterns:
+  KERNEL: '_Z\w+'
+rules:
+  - match: '^%{INT},2,%{INT:session},%{INT:client_id},%{BASE16NUM},%{KERNEL:name},%{INT:runtime},%{INT:calls}'
+    labels: [session, client_id, name]
+    metrics:
+      - value: runtime
+        name: asaka_kernel_running_time
+        help: kernel total running time
+      - value: calls
+        name: asaka_kernel_call_count
+        help: kernel total call count
+  - match: '^%{INT},1,%{INT:session},%{INT:client_id},(?P<api>\w+),%{INT:runtime}'
+    labels: [session, client_id, api]
+    metrics:
+      - value: runtime
+        name: asaka_api_running_time
+        help: api total running time
+`
+)
+
+func TestExpandGrok(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected string
+		err      string
+	}{
+		{"%{INT:id} %{WORD}", `(?P<id>[+-]?[0-9]+) (?:\w+)`, ""},
+		{"%{TIME}", `(?:[0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)?)`, ""},
+		{"%{UNKNOWN}", "", "unknown pattern"},
+		{"%{LOOP}", "", "nested too deep"},
+	}
+	patterns := map[string]string{"LOOP": "%{LOOP}"}
+	for name, p := range grokPatterns {
+		patterns[name] = p
+	}
+	for idx, c := range cases {
+		res, err := expandGrok(c.expr, patterns)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Case #%d, actual error: %v, expected: %v", idx+1, err, c.err)
+			}
+			continue
+		}
+		if res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+}
+
+func TestRegexPusher(t *testing.T) {
+	p, err := NewRegex(regex_conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range asaka_monitor_data {
+		p.(*regex).ParseAndPush(data)
+	}
+	p.(*regex).ParseAndPush("not an asaka line")
+	p.(*regex).ParseAndPush("")
+
+	cases := []struct {
+		metric   string
+		labels   map[string]string
+		expected float64
+	}{
+		{"asaka_kernel_running_time", map[string]string{"name": "_Z13FFT512_deviceI6float2fEvPT_"}, 130},
+		{"asaka_kernel_call_count", map[string]string{"name": "_Z13FFT512_deviceI6float2fEvPT_"}, 10},
+		{"asaka_api_running_time", map[string]string{"api": "TEST"}, 983},
+		{"hana_regex_unmatched_lines_total", nil, 1},
+	}
+	for idx, c := range cases {
+		res, ok := gatheredValue(t, p, c.metric, c.labels)
+		if !ok || res != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, res, c.expected)
+		}
+	}
+	if res, ok := gatheredValue(t, p, "hana_parse_errors_total", map[string]string{"reason": reasonUnmatched}); ok {
+		t.Errorf("actual: %v, expected: unmatched lines ignored by default", res)
+	}
+	if _, err := NewRegex(regex_conf + "unmatched: drop\n"); err == nil {
+		t.Errorf("unknown unmatched accepted")
+	}
+}
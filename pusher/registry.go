@@ -0,0 +1,98 @@
+package pusher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a pusher from its YAML config
+type Factory func(conf string) (Pusher, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+	factoryKeys = map[string][]string{}
+)
+
+// Register makes a pusher available by name, names are case insensitive.
+// keys are the config keys read by the pusher, configs with other keys are
+// rejected, they aren't checked if no keys are given. Register panics if it
+// is called twice with the same name or factory is nil.
+func Register(name string, factory Factory, keys ...string) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("pusher: Register factory is nil")
+	}
+	name = strings.ToLower(name)
+	if _, dup := factories[name]; dup {
+		panic("pusher: Register called twice for " + name)
+	}
+	factories[name] = factory
+	factoryKeys[name] = keys
+}
+
+// New creates a pusher by the factory registered as name
+func New(name, conf string) (Pusher, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[strings.ToLower(name)]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q", name)
+	}
+	return factory(conf)
+}
+
+// Keys returns the config keys of the pusher registered as name, nil if they
+// aren't declared
+func Keys(name string) []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	return factoryKeys[strings.ToLower(name)]
+}
+
+// Names returns the sorted names of the registered pushers
+func Names() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// baseKeys are the config keys read by base, the gateway and the gatherer
+var baseKeys = []string{
+	"pipeline", "filepath", "constlabels", "logparsed",
+	"pushurl", "pushjob", "pushinstance", "pushgrouping", "pushinterval", "pushretries", "pushbackoff", "pushtimeout", "pushdelete",
+	"ttl", "metricttl", "endedinfo", "maxseries", "metricmaxseries", "overflow",
+	"deadletter", "deadlettermaxsize", "deadletterretention",
+	"rulefiles", "ruleinterval", "alertfiles", "alertinterval", "alertwebhooks", "alertmanagers",
+}
+
+// lineTimeKeys are the config keys read by lineTime
+var lineTimeKeys = []string{"timestamps", "timestamplayout", "timezone", "maxage", "maxageaction"}
+
+// joinKeys concatenates lists of config keys
+func joinKeys(lists ...[]string) []string {
+	var keys []string
+	for _, l := range lists {
+		keys = append(keys, l...)
+	}
+	return keys
+}
+
+func init() {
+	Register("asaka", NewAsaka, joinKeys(baseKeys, lineTimeKeys, []string{
+		"accumulation", "apinamemap", "apinamemapfile", "apinamemapinterval",
+		"demangle", "demanglelabels", "derived", "memcpyapis", "runningtimeunit", "latency",
+	})...)
+	Register("gpumeta", NewGPUMeta, joinKeys(baseKeys, lineTimeKeys, []string{"types", "procfs", "processinterval"})...)
+	Register("csv", NewCSV, joinKeys(baseKeys, []string{"separator", "typecolumn", "records"})...)
+	Register("regex", NewRegex, joinKeys(baseKeys, []string{"patterns", "rules", "unmatched"})...)
+	Register("json", NewJSON, joinKeys(baseKeys, []string{"samples", "timestamp", "timestampformat", "labels", "metrics"})...)
+}
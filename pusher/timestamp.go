@@ -0,0 +1,116 @@
+package pusher
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// timestampUnix is the layout of epoch seconds
+	timestampUnix = "unix"
+
+	maxAgeDrop = "drop"
+	maxAgeFlag = "flag"
+)
+
+// lineTime parses the timestamp column of a line and checks its age:
+//
+//	timestamplayout: "unix" or a Go time layout, default depends on datasource
+//	timezone:        location of timestamps without zone, default Local
+//	timestamps:      expose samples with the line timestamp, default false
+//	maxage:          lines older than maxage are late, default 0 (disabled)
+//	maxageaction:    "drop" (default) or "flag" late lines
+type lineTime struct {
+	layout   string
+	location *time.Location
+	expose   bool
+	maxAge   time.Duration
+	drop     bool
+	now      func() time.Time
+	last     time.Time
+
+	lastMetric prometheus.Gauge
+	lateMetric prometheus.Counter
+}
+
+func newLineTime(cfg *config.Config, defaultLayout string) (*lineTime, error) {
+	location, err := time.LoadLocation(cfg.UString("timezone", "Local"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone, %v", err)
+	}
+	maxAge, err := time.ParseDuration(cfg.UString("maxage", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxage, %v", err)
+	}
+	action := strings.ToLower(cfg.UString("maxageaction", maxAgeDrop))
+	if action != maxAgeDrop && action != maxAgeFlag {
+		return nil, fmt.Errorf("unknown maxageaction %q", action)
+	}
+	return &lineTime{
+		layout:   cfg.UString("timestamplayout", defaultLayout),
+		location: location,
+		expose:   cfg.UBool("timestamps", false),
+		maxAge:   maxAge,
+		drop:     action == maxAgeDrop,
+		now:      time.Now,
+		lastMetric: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "hana_last_sample_timestamp_seconds",
+				Help: "timestamp of the latest line of the pipeline",
+			},
+		),
+		lateMetric: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "hana_late_lines_total",
+				Help: "lines older than the configured max age",
+			},
+		),
+	}, nil
+}
+
+func (l *lineTime) collectors() []prometheus.Collector {
+	return []prometheus.Collector{l.lastMetric, l.lateMetric}
+}
+
+func (l *lineTime) parse(field string) (time.Time, error) {
+	field = strings.TrimSpace(field)
+	if l.layout == timestampUnix {
+		sec, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		whole, frac := math.Modf(sec)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	}
+	return time.ParseInLocation(l.layout, field, l.location)
+}
+
+// check parses the timestamp field of a line, it returns the timestamp to
+// attach to samples, zero unless exposing timestamps, and whether the line
+// should be pushed
+func (l *lineTime) check(field string) (time.Time, bool, error) {
+	ts, err := l.parse(field)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if l.maxAge > 0 && l.now().Sub(ts) > l.maxAge {
+		l.lateMetric.Inc()
+		if l.drop {
+			return time.Time{}, false, nil
+		}
+	}
+	if ts.After(l.last) {
+		l.last = ts
+		l.lastMetric.Set(float64(ts.UnixNano()) / 1e9)
+	}
+	if !l.expose {
+		return time.Time{}, true, nil
+	}
+	return ts, true, nil
+}
@@ -0,0 +1,141 @@
+package pusher
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/olebedev/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestLineTime(t *testing.T) {
+	now := time.Date(2017, 9, 18, 0, 30, 0, 0, time.UTC)
+	cases := []struct {
+		conf     string
+		layout   string
+		field    string
+		expected time.Time
+		ok       bool
+		late     bool
+	}{
+		{"timestamps: true", timestampUnix, "1505694600", time.Unix(1505694600, 0), true, false},
+		{"timestamps: true\ntimezone: UTC", gpuMetaTimestampLayout, "2017/09/18 00:28:08.188",
+			time.Date(2017, 9, 18, 0, 28, 8, 188000000, time.UTC), true, false},
+		{"timestamps: true\ntimezone: Asia/Tokyo", gpuMetaTimestampLayout, "2017/09/18 09:28:08.188",
+			time.Date(2017, 9, 18, 0, 28, 8, 188000000, time.UTC), true, false},
+		{"timezone: UTC", gpuMetaTimestampLayout, "2017/09/18 00:28:08.188", time.Time{}, true, false},
+		{"timezone: UTC\nmaxage: 1m", gpuMetaTimestampLayout, "2017/09/18 00:28:08.188", time.Time{}, false, true},
+		{"timezone: UTC\nmaxage: 1m\nmaxageaction: flag", gpuMetaTimestampLayout, "2017/09/18 00:28:08.188", time.Time{}, true, true},
+		{"maxage: 5m", timestampUnix, "1505694600", time.Time{}, true, false},
+	}
+	for idx, c := range cases {
+		cfg, err := config.ParseYaml(c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt, err := newLineTime(cfg, c.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt.now = func() time.Time { return now }
+		res, ok, err := lt.check(c.field)
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error: %v", idx+1, err)
+			continue
+		}
+		if !res.Equal(c.expected) || ok != c.ok || lt.last.IsZero() == c.ok {
+			t.Errorf("Case #%d, actual: %v %v, expected: %v %v", idx+1, res, ok, c.expected, c.ok)
+		}
+		if late := counterValue(t, lt) > 0; late != c.late {
+			t.Errorf("Case #%d, actual late: %v, expected: %v", idx+1, late, c.late)
+		}
+	}
+}
+
+func counterValue(t *testing.T, lt *lineTime) float64 {
+	m := &dto.Metric{}
+	if err := lt.lateMetric.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestAsakaTimestamps(t *testing.T) {
+	p, err := NewAsaka("pushurl: http://127.0.0.1:9091\ntimestamps: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.(*asaka).ParseAndPush("1504171516,1,0,1,TEST,983,4,2097154")
+	p.(*asaka).ParseAndPush("bad,1,0,1,TEST,1,1,1")
+
+	mfs, err := p.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "asaka_api_running_time":
+			found = true
+			if m := mf.Metric[0]; m.GetTimestampMs() != 1504171516000 || m.GetGauge().GetValue() != 983 {
+				t.Errorf("unexpected sample: %v", m)
+			}
+		case "hana_last_sample_timestamp_seconds":
+			if v := mf.Metric[0].GetGauge().GetValue(); v != 1504171516 {
+				t.Errorf("actual last sample timestamp: %v, expected: 1504171516", v)
+			}
+		}
+	}
+	if !found {
+		t.Error("asaka_api_running_time not gathered")
+	}
+}
+
+// TestMetricGatherConcurrent checks gathering more series than a collect
+// buffers doesn't block samples set meanwhile
+func TestMetricGatherConcurrent(t *testing.T) {
+	m := newMetric(metricSpec{name: "test", help: "test", typ: metricTypeGauge}, []string{"id"})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.collector())
+	ts := time.Unix(1504171516, 0)
+	for i := 0; i < 2000; i++ {
+		m.setAt([]string{strconv.Itoa(i)}, 1, ts)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m.setAt([]string{strconv.Itoa(i % 3000)}, float64(i), ts)
+			m.delete([]string{strconv.Itoa(2000 + i%1000)})
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		done := make(chan []*dto.MetricFamily)
+		go func() {
+			mfs, err := registry.Gather()
+			if err != nil {
+				t.Error(err)
+			}
+			done <- mfs
+		}()
+		select {
+		case mfs := <-done:
+			if len(mfs) != 1 || len(mfs[0].Metric) < 2000 {
+				t.Fatalf("Case #%d, actual: %v families, expected: 1 with at least 2000 series", i+1, len(mfs))
+			}
+			if m := mfs[0].Metric[0]; m.GetTimestampMs() != 1504171516000 {
+				t.Errorf("Case #%d, actual: %v, expected: timestamp 1504171516000", i+1, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Case #%d, gather blocked", i+1)
+		}
+	}
+}
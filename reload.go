@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ksang/hana/datasource"
+	"github.com/ksang/hana/pusher"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+// pipeline is the consumer and parser of a pipeline config
+type pipeline struct {
+	config   *PipelineConfig
+	consumer datasource.Consumer
+	pusher   pusher.Pusher
+	// lines is the channel of the started consumer
+	lines <-chan string
+}
+
+// newPipeline creates the consumer and parser of a pipeline without
+// starting them
+func newPipeline(pc *PipelineConfig) (*pipeline, error) {
+	consumer, err := datasource.New(pc.Consumer, pc.Conf)
+	if err != nil {
+		return nil, err
+	}
+	p, err := pusher.New(pc.Parser, pc.Conf)
+	if err != nil {
+		return nil, err
+	}
+	return &pipeline{config: pc, consumer: consumer, pusher: p}, nil
+}
+
+// reparse creates a pipeline of pc parsing the lines of the running
+// consumer of p, its parser is started by startPusher
+func (p *pipeline) reparse(pc *PipelineConfig) (*pipeline, error) {
+	np, err := pusher.New(pc.Parser, pc.Conf)
+	if err != nil {
+		return nil, err
+	}
+	return &pipeline{config: pc, consumer: p.consumer, pusher: np, lines: p.lines}, nil
+}
+
+// start starts the consumer and parser, errors are logged until they end
+func (p *pipeline) start() error {
+	lines, err := p.consumer.Start(context.Background())
+	if err != nil {
+		return err
+	}
+	p.lines = lines
+	if err := p.startPusher(); err != nil {
+		p.consumer.Stop()
+		return err
+	}
+	go p.watchConsumer()
+	return nil
+}
+
+// startPusher starts the parser on the lines of the started consumer
+func (p *pipeline) startPusher() error {
+	if err := p.pusher.Start(context.Background(), p.lines); err != nil {
+		return err
+	}
+	go p.watchPusher()
+	return nil
+}
+
+// watchConsumer logs the errors of the consumer until it ended, and the
+// error ending it
+func (p *pipeline) watchConsumer() {
+	for err := range p.consumer.Errors() {
+		log.Printf("consumer of pipeline %s failed, %v", p.config.Name, err)
+	}
+	if err := p.consumer.Stop(); err != nil {
+		log.Printf("consumer of pipeline %s ended, %v", p.config.Name, err)
+	}
+}
+
+// watchPusher logs the errors of the parser until it ended
+func (p *pipeline) watchPusher() {
+	for err := range p.pusher.Errors() {
+		log.Printf("parser of pipeline %s failed, %v", p.config.Name, err)
+	}
+}
+
+func (p *pipeline) stop() {
+	if err := p.consumer.Stop(); err != nil {
+		log.Printf("failed to stop consumer of pipeline %s, %v", p.config.Name, err)
+	}
+	p.stopPusher()
+}
+
+// keepPushGroup keeps the Pushgateway group of p from being deleted when its
+// parser stops if the parser of np pushes to the same group
+func (p *pipeline) keepPushGroup(np *pipeline) {
+	old, ok := p.pusher.(pusher.PushGroup)
+	if !ok {
+		return
+	}
+	if g, ok := np.pusher.(pusher.PushGroup); ok && len(g.PushGroupURL()) > 0 && g.PushGroupURL() == old.PushGroupURL() {
+		old.KeepPushGroup()
+	}
+}
+
+// failed reports whether the consumer or parser ended while the pipeline
+// is running, or the pipeline failed to start
+func (p *pipeline) failed() bool {
+	select {
+	case <-p.consumer.Done():
+		return true
+	case <-p.pusher.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// stopPusher stops the parser, the consumer keeps running
+func (p *pipeline) stopPusher() {
+	if err := p.pusher.Stop(); err != nil {
+		log.Printf("failed to stop parser of pipeline %s, %v", p.config.Name, err)
+	}
+}
+
+// shutdown stops the consumer, draining it if it is a datasource.Drainer,
+// waits until the parser parsed the lines in flight and performed its final
+// push, it fails if this doesn't complete before ctx is done
+func (p *pipeline) shutdown(ctx context.Context) error {
+	stop := p.consumer.Stop
+	if d, ok := p.consumer.(datasource.Drainer); ok {
+		stop = func() error { return d.Drain(ctx) }
+	}
+	if err := stop(); err != nil {
+		log.Printf("failed to stop consumer of pipeline %s, %v", p.config.Name, err)
+	}
+	select {
+	case <-p.pusher.Done():
+	case <-ctx.Done():
+		go p.pusher.Stop()
+		return fmt.Errorf("pipeline %s: lines not drained and pushed, %v", p.config.Name, ctx.Err())
+	}
+	if err := p.pusher.Stop(); err != nil {
+		return fmt.Errorf("pipeline %s: final push failed, %v", p.config.Name, err)
+	}
+	return nil
+}
+
+// pipelineSet runs the pipelines of the config and exposes their merged
+// metrics and the reload metrics as gatherer. Pipelines which failed stay in
+// the set, exposed by hana_pipeline_up, until a reload restarts them.
+type pipelineSet struct {
+	paths []string
+
+	// reloadMu serializes reloads, mu guards the running pipelines
+	reloadMu  sync.Mutex
+	mu        sync.RWMutex
+	pipelines []*pipeline
+	server    ServerConfig
+	loaded    bool
+	closed    bool
+
+	registry              *prometheus.Registry
+	reloadsMetric         *prometheus.CounterVec
+	lastSuccessMetric     prometheus.Gauge
+	lastSuccessTimeMetric prometheus.Gauge
+}
+
+// newPipelineSet creates a set running the pipelines of the config files
+// at paths, nothing runs until reload is called
+func newPipelineSet(paths []string) *pipelineSet {
+	s := &pipelineSet{
+		paths:    paths,
+		registry: prometheus.NewRegistry(),
+		reloadsMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_config_reloads_total",
+				Help: "config reloads by result",
+			},
+			[]string{"result"},
+		),
+		lastSuccessMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hana_config_last_reload_successful",
+			Help: "whether the last config reload succeeded",
+		}),
+		lastSuccessTimeMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hana_config_last_reload_success_timestamp_seconds",
+			Help: "timestamp of the last successful config reload",
+		}),
+	}
+	s.registry.MustRegister(s.reloadsMetric, s.lastSuccessMetric, s.lastSuccessTimeMetric, &upCollector{
+		set: s,
+		desc: prometheus.NewDesc(
+			"hana_pipeline_up",
+			"whether the consumer and parser of the pipeline are running",
+			[]string{pusher.PipelineLabel}, nil,
+		),
+	})
+	return s
+}
+
+// upCollector exposes whether the pipelines of a set are running
+type upCollector struct {
+	set  *pipelineSet
+	desc *prometheus.Desc
+}
+
+func (c *upCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *upCollector) Collect(ch chan<- prometheus.Metric) {
+	c.set.mu.RLock()
+	defer c.set.mu.RUnlock()
+	for _, p := range c.set.pipelines {
+		up := 1.0
+		if p.failed() {
+			up = 0
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, up, p.config.Name)
+	}
+}
+
+// reload reads the config files and applies their pipelines, the running
+// pipelines are kept if the config is invalid
+func (s *pipelineSet) reload() (*Config, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("pipelines are shut down")
+	}
+	cfg, err := loadConfig(s.paths)
+	if err == nil {
+		err = s.apply(cfg)
+	}
+	if err != nil {
+		s.reloadsMetric.WithLabelValues("failure").Inc()
+		s.lastSuccessMetric.Set(0)
+		return nil, err
+	}
+	s.reloadsMetric.WithLabelValues("success").Inc()
+	s.lastSuccessMetric.Set(1)
+	s.lastSuccessTimeMetric.Set(float64(time.Now().Unix()))
+	return cfg, nil
+}
+
+// apply starts pipelines which are new or changed and stops pipelines which
+// are removed or changed, unchanged pipelines keep running. Pipelines whose
+// consumer config is unchanged keep their consumer and tail position, only
+// their parser is replaced, with pushdelete the Pushgateway group isn't
+// deleted if the new parser pushes to the same group. Failed pipelines are
+// restarted. Nothing is changed if a pipeline can't be created.
+func (s *pipelineSet) apply(cfg *Config) error {
+	s.mu.RLock()
+	running := map[string]*pipeline{}
+	failed := map[*pipeline]bool{}
+	for _, p := range s.pipelines {
+		running[p.config.Name] = p
+		failed[p] = p.failed()
+	}
+	server, loaded := s.server, s.loaded
+	s.mu.RUnlock()
+
+	var next []*pipeline
+	// kept are the unchanged running pipelines, reparsed the running
+	// pipelines and their replacement keeping the consumer
+	kept := map[*pipeline]bool{}
+	reparsed := map[*pipeline]*pipeline{}
+	for _, pc := range cfg.Pipelines {
+		old, ok := running[pc.Name]
+		if ok && failed[old] {
+			ok = false
+		}
+		if ok && old.config.Consumer == pc.Consumer &&
+			old.config.Parser == pc.Parser && old.config.Conf == pc.Conf {
+			next = append(next, old)
+			kept[old] = true
+			continue
+		}
+		var p *pipeline
+		var err error
+		if ok && sameConsumer(old.config, pc) {
+			if p, err = old.reparse(pc); err == nil {
+				reparsed[old] = p
+			}
+		} else {
+			p, err = newPipeline(pc)
+		}
+		if err != nil {
+			return fmt.Errorf("pipeline %s: %v", pc.Name, err)
+		}
+		next = append(next, p)
+	}
+	if loaded && server != cfg.Server {
+		log.Println("server config changed, it takes effect on restart")
+	}
+
+	replacements := map[*pipeline]bool{}
+	for _, p := range running {
+		if kept[p] {
+			continue
+		}
+		if np, ok := reparsed[p]; ok {
+			log.Println("stopping parser of pipeline", p.config.Name)
+			p.keepPushGroup(np)
+			p.stopPusher()
+			replacements[np] = true
+			continue
+		}
+		if failed[p] {
+			log.Println("stopping failed pipeline", p.config.Name)
+		} else {
+			log.Println("stopping pipeline", p.config.Name)
+		}
+		p.stop()
+	}
+	// pipelines which fail to start are kept as failed
+	var errs []error
+	for _, p := range next {
+		var err error
+		switch {
+		case kept[p]:
+		case replacements[p]:
+			log.Println("starting parser of pipeline", p.config.Name)
+			err = p.startPusher()
+		default:
+			log.Println("starting pipeline", p.config.Name)
+			err = p.start()
+		}
+		if err != nil {
+			p.stop()
+			errs = append(errs, fmt.Errorf("pipeline %s: %v", p.config.Name, err))
+		}
+	}
+
+	s.mu.Lock()
+	s.pipelines = next
+	if !loaded {
+		s.server, s.loaded = cfg.Server, true
+	}
+	s.mu.Unlock()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// sameConsumer reports whether the pipeline configs have the same consumer
+// config, the keys declared by the consumer are compared if it declares them
+func sameConsumer(a, b *PipelineConfig) bool {
+	if a.Consumer != b.Consumer {
+		return false
+	}
+	keys := datasource.Keys(a.Consumer)
+	if keys == nil {
+		return a.Conf == b.Conf
+	}
+	confA, confB := map[string]interface{}{}, map[string]interface{}{}
+	if yaml.Unmarshal([]byte(a.Conf), &confA) != nil || yaml.Unmarshal([]byte(b.Conf), &confB) != nil {
+		return false
+	}
+	for _, k := range keys {
+		if !reflect.DeepEqual(confA[k], confB[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdown drains all pipelines concurrently, they keep exposing their
+// metrics until they are stopped, reloads fail afterwards
+func (s *pipelineSet) shutdown(ctx context.Context) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.closed = true
+	s.mu.RLock()
+	pipelines := s.pipelines
+	s.mu.RUnlock()
+	errCh := make(chan error, len(pipelines))
+	for _, p := range pipelines {
+		go func(p *pipeline) {
+			errCh <- p.shutdown(ctx)
+		}(p)
+	}
+	var errs []string
+	for range pipelines {
+		if err := <-errCh; err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Gather merges the metrics of the running pipelines and the reload metrics,
+// constlabels missing in a pipeline are added empty to keep the label names
+// of merged metrics consistent
+func (s *pipelineSet) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.RLock()
+	names := map[string]bool{}
+	for _, p := range s.pipelines {
+		for name := range p.config.ConstLabels {
+			names[name] = true
+		}
+	}
+	gatherers := prometheus.Gatherers{s.registry}
+	for _, p := range s.pipelines {
+		var missing []string
+		for name := range names {
+			if _, ok := p.config.ConstLabels[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		g := p.pusher.Gatherer()
+		if len(missing) > 0 {
+			g = &padGatherer{gatherer: g, names: missing}
+		}
+		gatherers = append(gatherers, g)
+	}
+	s.mu.RUnlock()
+	return gatherers.Gather()
+}
+
+// padGatherer adds empty labels of names to every metric without them
+type padGatherer struct {
+	gatherer prometheus.Gatherer
+	names    []string
+}
+
+func (p *padGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := p.gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, name := range p.names {
+				if hasLabel(m, name) {
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(name),
+					Value: proto.String(""),
+				})
+			}
+			sort.Sort(prometheus.LabelPairSorter(m.Label))
+		}
+	}
+	return mfs, err
+}
+
+// reloadHandler reloads the config on POST requests
+func reloadHandler(s *pipelineSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, err := s.reload(); err != nil {
+			log.Println("failed to reload config,", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Println("config reloaded")
+	})
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, lp := range m.Label {
+		if lp.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
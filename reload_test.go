@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatheredValues returns the values of a metric by pipeline label
+func gatheredValues(t *testing.T, s *pipelineSet, name string) map[string]float64 {
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.Metric {
+			key := ""
+			for _, lp := range m.Label {
+				if lp.GetName() == "pipeline" || lp.GetName() == "result" {
+					key = lp.GetValue()
+				}
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				values[key] += m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				values[key] += m.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPipelineSetReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		line := fmt.Sprintf("%d,1,0,2,cuda_init,2,1,0\n", time.Now().Unix())
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(line), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	confPath := filepath.Join(dir, "hana.conf")
+	writeConf := func(pipelines ...string) {
+		content := "pipelines:\n"
+		for _, p := range pipelines {
+			content += p
+		}
+		if err := ioutil.WriteFile(confPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pipelineA := fmt.Sprintf("  - {name: a, parser: asaka, filepath: %s}\n", filepath.Join(dir, "a.log"))
+	pipelineB := fmt.Sprintf("  - {name: b, parser: asaka, filepath: %s}\n", filepath.Join(dir, "b.log"))
+	pipelineB2 := fmt.Sprintf("  - {name: b, parser: asaka, filepath: %s, constlabels: {node: n1}}\n", filepath.Join(dir, "b.log"))
+	pipelineC := fmt.Sprintf("  - {name: c, parser: asaka, filepath: %s}\n", filepath.Join(dir, "c.log"))
+
+	s := newPipelineSet([]string{confPath})
+	defer s.shutdown(context.Background())
+	writeConf(pipelineA, pipelineB)
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(gatheredValues(t, s, "hana_last_sample_timestamp_seconds")) == 2 })
+	a, b := s.pipelines[0], s.pipelines[1]
+
+	// a is unchanged, b is changed and c is added
+	writeConf(pipelineA, pipelineB2, pipelineC)
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.pipelines) != 3 || s.pipelines[0] != a || s.pipelines[1] == b || s.pipelines[1].consumer != b.consumer {
+		t.Errorf("actual: %v, expected: a kept, parser of b restarted and c started", s.pipelines)
+	}
+	waitFor(t, func() bool { return len(gatheredValues(t, s, "hana_last_sample_timestamp_seconds")) == 3 })
+
+	// b and c are removed
+	writeConf(pipelineA)
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.pipelines) != 1 || s.pipelines[0] != a {
+		t.Errorf("actual: %v, expected: a kept", s.pipelines)
+	}
+
+	// invalid configs keep the running pipelines
+	writeConf("  - {name: a, parser: unknown}\n")
+	if _, err := s.reload(); err == nil {
+		t.Errorf("actual: %v, expected: error", err)
+	}
+	if len(s.pipelines) != 1 || s.pipelines[0] != a {
+		t.Errorf("actual: %v, expected: a kept", s.pipelines)
+	}
+
+	reloads := gatheredValues(t, s, "hana_config_reloads_total")
+	if reloads["success"] != 3 || reloads["failure"] != 1 {
+		t.Errorf("actual: %v, expected: 3 successful and 1 failed reloads", reloads)
+	}
+	if v := gatheredValues(t, s, "hana_config_last_reload_successful")[""]; v != 0 {
+		t.Errorf("actual: %v, expected: 0", v)
+	}
+}
+
+// TestPipelineSetReloadKeepsTail checks a pipeline whose parser config
+// changed keeps reading from its tail position instead of replaying the file
+func TestPipelineSetReloadKeepsTail(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"a.log": "invalid\ninvalid\n"})
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "a.log")
+	confPath := filepath.Join(dir, "hana.conf")
+	writeConf := func(node string) {
+		conf := fmt.Sprintf("filepath: %s\nparser: asaka\nconstlabels: {node: %s}\n", logPath, node)
+		if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newPipelineSet([]string{confPath})
+	defer s.shutdown(context.Background())
+	parseErrors := func() float64 {
+		return gatheredValues(t, s, "hana_parse_errors_total")[logPath]
+	}
+	writeConf("n1")
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return parseErrors() == 2 })
+
+	writeConf("n2")
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("invalid\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	waitFor(t, func() bool { return parseErrors() > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if v := parseErrors(); v != 1 {
+		t.Errorf("actual: %v, expected: 1", v)
+	}
+}
+
+func TestPipelineSetReloadKeepsPushGroup(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		deletes []string
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			mu.Lock()
+			deletes = append(deletes, r.URL.Path)
+			mu.Unlock()
+		}
+	}))
+	defer gateway.Close()
+	dir := writeTestFiles(t, map[string]string{"a.log": ""})
+	defer os.RemoveAll(dir)
+	confPath := filepath.Join(dir, "hana.conf")
+	writeConf := func(job, node, interval string) {
+		conf := fmt.Sprintf("filepath: %s\nparser: asaka\nconstlabels: {node: %s}\n"+
+			"pushurl: '%s'\npushjob: %s\npushinstance: i\npushinterval: %s\npushdelete: true\n",
+			filepath.Join(dir, "a.log"), node, gateway.URL, job, interval)
+		if err := ioutil.WriteFile(confPath, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newPipelineSet([]string{confPath})
+	defer s.shutdown(context.Background())
+	cases := []struct {
+		job      string
+		node     string
+		interval string
+		err      bool
+		expected []string
+	}{
+		{"a", "n1", "1h", false, nil},
+		{"a", "n2", "1h", false, nil},
+		// a parser config which can't be built keeps the running pipeline
+		{"b", "n3", "0s", true, nil},
+		{"b", "n2", "1h", false, []string{"/metrics/job/a/instance/i"}},
+	}
+	for idx, c := range cases {
+		mu.Lock()
+		deletes = nil
+		mu.Unlock()
+		running := s.pipelines
+		writeConf(c.job, c.node, c.interval)
+		if _, err := s.reload(); (err != nil) != c.err {
+			t.Errorf("Case #%d, actual: %v, expected error: %v", idx+1, err, c.err)
+		}
+		if c.err && (len(s.pipelines) != 1 || s.pipelines[0] != running[0] || s.pipelines[0].failed()) {
+			t.Errorf("Case #%d, actual: %v, expected: running pipeline kept", idx+1, s.pipelines)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(deletes, c.expected) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, deletes, c.expected)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confPath := filepath.Join(dir, "hana.conf")
+	logPath := filepath.Join(dir, "a.log")
+	if err := ioutil.WriteFile(logPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newPipelineSet([]string{confPath})
+	defer s.shutdown(context.Background())
+	srv := httptest.NewServer(reloadHandler(s))
+	defer srv.Close()
+
+	cases := []struct {
+		method   string
+		conf     string
+		expected int
+	}{
+		{http.MethodGet, "filepath: " + logPath + "\nparser: asaka\n", http.StatusMethodNotAllowed},
+		{http.MethodPost, "filepath: " + logPath + "\nparser: asaka\n", http.StatusOK},
+		{http.MethodPost, "filepath: " + logPath + "\nparser: unknown\n", http.StatusInternalServerError},
+	}
+
+	for idx, c := range cases {
+		if err := ioutil.WriteFile(confPath, []byte(c.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(c.method, srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, resp.StatusCode, c.expected)
+		}
+	}
+}
+
+func TestPipelineSetShutdown(t *testing.T) {
+	pushes := map[string]int{}
+	var mu sync.Mutex
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		pushes[r.URL.Path]++
+		mu.Unlock()
+		if strings.Contains(r.URL.Path, "/job/failing") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer gateway.Close()
+	dir := writeTestFiles(t, map[string]string{"a.log": "", "b.log": ""})
+	defer os.RemoveAll(dir)
+	pipeline := func(name, job string) string {
+		return fmt.Sprintf("  - {name: %s, parser: asaka, filepath: %s, pushurl: '%s', pushjob: %s, pushinstance: %s, pushretries: 0}\n",
+			name, filepath.Join(dir, name+".log"), gateway.URL, job, name)
+	}
+	cases := []struct {
+		pipelines []string
+		err       string
+	}{
+		{[]string{pipeline("a", "ok"), pipeline("b", "ok")}, ""},
+		{[]string{pipeline("a", "ok"), pipeline("b", "failing")}, "pipeline b: final push failed"},
+	}
+
+	for idx, c := range cases {
+		content := "pipelines:\n" + strings.Join(c.pipelines, "")
+		confPath := filepath.Join(dir, "hana.conf")
+		if err := ioutil.WriteFile(confPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s := newPipelineSet([]string{confPath})
+		if _, err := s.reload(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		pushes = map[string]int{}
+		mu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := s.shutdown(ctx)
+		cancel()
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		if !strings.HasPrefix(actual, c.err) || (len(c.err) == 0) != (err == nil) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, actual, c.err)
+		}
+		mu.Lock()
+		if len(pushes) != 2 {
+			t.Errorf("Case #%d, actual final pushes: %v, expected: 2 groups", idx+1, pushes)
+		}
+		mu.Unlock()
+		if _, err := s.reload(); err == nil {
+			t.Errorf("Case #%d, actual: %v, expected: reload error after shutdown", idx+1, err)
+		}
+	}
+}
+
+// TestPipelineSetShutdownDrains checks lines written right before shutdown
+// are parsed
+func TestPipelineSetShutdownDrains(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"a.log": "invalid\n"})
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "a.log")
+	confPath := filepath.Join(dir, "hana.conf")
+	if err := ioutil.WriteFile(confPath, []byte("filepath: "+logPath+"\nparser: asaka\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newPipelineSet([]string{confPath})
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	parseErrors := func() float64 {
+		return gatheredValues(t, s, "hana_parse_errors_total")[logPath]
+	}
+	waitFor(t, func() bool { return parseErrors() == 1 })
+	// the tail watches the file once it reached its end
+	time.Sleep(100 * time.Millisecond)
+
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(strings.Repeat("invalid\n", 50)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v := parseErrors(); v != 51 {
+		t.Errorf("actual: %v, expected: 51", v)
+	}
+}
+
+// TestPipelineSetRestartsFailed checks a pipeline whose consumer ended is
+// exposed as down and restarted by a reload of the unchanged config
+func TestPipelineSetRestartsFailed(t *testing.T) {
+	dir := writeTestFiles(t, nil)
+	defer os.RemoveAll(dir)
+	// reading the directory fails the consumer
+	logPath := filepath.Join(dir, "a.log")
+	if err := os.Mkdir(logPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	confPath := filepath.Join(dir, "hana.conf")
+	if err := ioutil.WriteFile(confPath, []byte("pipelines:\n  - {name: a, parser: asaka, filepath: "+logPath+"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newPipelineSet([]string{confPath})
+	defer s.shutdown(context.Background())
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		up, ok := gatheredValues(t, s, "hana_pipeline_up")["a"]
+		return ok && up == 0
+	})
+	if len(s.pipelines) != 1 {
+		t.Errorf("actual: %v, expected: failed pipeline a kept", s.pipelines)
+	}
+
+	if err := os.Remove(logPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(logPath, []byte("invalid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v := gatheredValues(t, s, "hana_pipeline_up")["a"]; v != 1 {
+		t.Errorf("actual: %v, expected: 1", v)
+	}
+	waitFor(t, func() bool { return gatheredValues(t, s, "hana_parse_errors_total")["a"] == 1 })
+}
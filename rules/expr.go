@@ -0,0 +1,644 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sample is a series of a vector, labels don't include the metric name
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Expr is a parsed rule expression, a subset of PromQL:
+//
+//	sum/avg/max/min/count [by|without (labels)] (expr) [by|without (labels)]
+//	metric{label="v", label!="v", label=~"re", label!~"re"}
+//	expr + - * / expr, between vectors of equal labels or vectors and numbers
+//	numbers and parentheses
+type Expr interface {
+	eval(data map[string][]Sample) (value, error)
+	String() string
+}
+
+// value is the result of an expression, a vector or a scalar
+type value struct {
+	scalar bool
+	s      float64
+	v      []Sample
+}
+
+// ParseExpr parses an expression
+func ParseExpr(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return e, nil
+}
+
+// Eval evaluates an expression over the samples of metrics by name, scalar
+// results are returned as vector of one sample without labels
+func Eval(e Expr, data map[string][]Sample) ([]Sample, error) {
+	v, err := e.eval(data)
+	if err != nil {
+		return nil, err
+	}
+	if v.scalar {
+		return []Sample{{Labels: map[string]string{}, Value: v.s}}, nil
+	}
+	return v.v, nil
+}
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	typ  tokenType
+	text string
+	pos  int
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && c >= '0' && c <= '9')
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentChar(c, true):
+			start := i
+			for i < len(input) && isIdentChar(input[i], false) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, input[start:i], start})
+		case (c >= '0' && c <= '9') || c == '.':
+			start := i
+			for i < len(input) && (input[i] >= '0' && input[i] <= '9' || input[i] == '.' ||
+				input[i] == 'e' || input[i] == 'E' ||
+				(input[i] == '-' || input[i] == '+') && (input[i-1] == 'e' || input[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, input[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for ; i < len(input) && input[i] != c; i++ {
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+				}
+				sb.WriteByte(input[i])
+			}
+			if i >= len(input) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokenString, sb.String(), start})
+		default:
+			op := string(c)
+			if i+1 < len(input) {
+				switch two := input[i : i+2]; two {
+				case "!=", "=~", "!~":
+					op = two
+				}
+			}
+			if !operators[op] {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, token{tokenOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokenEOF, "end of expression", len(input)}), nil
+}
+
+var operators = map[string]bool{
+	"(": true, ")": true, "{": true, "}": true, ",": true,
+	"+": true, "-": true, "*": true, "/": true,
+	"=": true, "!=": true, "=~": true, "!~": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.typ == tokenOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q, got %q at offset %d", op, t.text, t.pos)
+	}
+	return nil
+}
+
+// expr ::= term (('+'|'-') term)*
+func (p *parser) expr() (Expr, error) {
+	lhs, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := "+"
+		if !p.accept(op) {
+			op = "-"
+			if !p.accept(op) {
+				return lhs, nil
+			}
+		}
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{op: op, lhs: lhs, rhs: rhs}
+	}
+}
+
+// term ::= factor (('*'|'/') factor)*
+func (p *parser) term() (Expr, error) {
+	lhs, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := "*"
+		if !p.accept(op) {
+			op = "/"
+			if !p.accept(op) {
+				return lhs, nil
+			}
+		}
+		rhs, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{op: op, lhs: lhs, rhs: rhs}
+	}
+}
+
+// factor ::= number | '-' factor | '(' expr ')' | aggregation | selector
+func (p *parser) factor() (Expr, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", t.text, t.pos)
+		}
+		return numberLiteral(v), nil
+	case tokenOp:
+		switch t.text {
+		case "-":
+			e, err := p.factor()
+			if err != nil {
+				return nil, err
+			}
+			return &binaryExpr{op: "-", lhs: numberLiteral(0), rhs: e}, nil
+		case "(":
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return &parenExpr{e}, nil
+		}
+	case tokenIdent:
+		if aggregations[t.text] && (p.peek().text == "(" || p.peek().text == "by" || p.peek().text == "without") {
+			return p.aggregation(t.text)
+		}
+		return p.selector(t.text)
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+var aggregations = map[string]bool{"sum": true, "avg": true, "max": true, "min": true, "count": true}
+
+// aggregation ::= op [grouping] '(' expr ')' [grouping]
+func (p *parser) aggregation(op string) (Expr, error) {
+	a := &aggregateExpr{op: op}
+	grouped, err := p.grouping(a)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if a.expr, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if !grouped {
+		if _, err := p.grouping(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// grouping ::= ('by'|'without') '(' label (',' label)* ')'
+func (p *parser) grouping(a *aggregateExpr) (bool, error) {
+	t := p.peek()
+	if t.typ != tokenIdent || (t.text != "by" && t.text != "without") {
+		return false, nil
+	}
+	p.next()
+	a.without = t.text == "without"
+	a.grouped = true
+	if err := p.expect("("); err != nil {
+		return false, err
+	}
+	for !p.accept(")") {
+		if len(a.labels) > 0 {
+			if err := p.expect(","); err != nil {
+				return false, err
+			}
+		}
+		l := p.next()
+		if l.typ != tokenIdent {
+			return false, fmt.Errorf("expected label name, got %q at offset %d", l.text, l.pos)
+		}
+		a.labels = append(a.labels, l.text)
+	}
+	return true, nil
+}
+
+// selector ::= name ['{' matcher (',' matcher)* '}']
+func (p *parser) selector(name string) (Expr, error) {
+	s := &selectorExpr{name: name}
+	if !p.accept("{") {
+		return s, nil
+	}
+	for !p.accept("}") {
+		if len(s.matchers) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		s.matchers = append(s.matchers, m)
+	}
+	return s, nil
+}
+
+// matcher ::= label ('='|'!='|'=~'|'!~') string
+func (p *parser) matcher() (*Matcher, error) {
+	l := p.next()
+	if l.typ != tokenIdent {
+		return nil, fmt.Errorf("expected label name, got %q at offset %d", l.text, l.pos)
+	}
+	op := p.next()
+	if op.typ != tokenOp || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+		return nil, fmt.Errorf("expected label matcher, got %q at offset %d", op.text, op.pos)
+	}
+	v := p.next()
+	if v.typ != tokenString {
+		return nil, fmt.Errorf("expected string, got %q at offset %d", v.text, v.pos)
+	}
+	return NewMatcher(l.text, op.text, v.text)
+}
+
+// ParseMatcher parses a label matcher such as name=~"Tesla.*"
+func ParseMatcher(input string) (*Matcher, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	m, err := p.matcher()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return m, nil
+}
+
+// Matcher matches the value of a label, a missing label has the empty value
+type Matcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher creates a matcher of op "=", "!=", "=~" or "!~", regular
+// expressions are anchored
+func NewMatcher(name, op, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Op: op, Value: value}
+	switch op {
+	case "=", "!=":
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown matcher operator %q", op)
+	}
+	return m, nil
+}
+
+// Matches checks the label of a series
+func (m *Matcher) Matches(labels map[string]string) bool {
+	v := labels[m.Name]
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.re.MatchString(v)
+	}
+	return !m.re.MatchString(v)
+}
+
+func (m *Matcher) String() string {
+	return m.Name + m.Op + strconv.Quote(m.Value)
+}
+
+type numberLiteral float64
+
+func (n numberLiteral) eval(map[string][]Sample) (value, error) {
+	return value{scalar: true, s: float64(n)}, nil
+}
+
+func (n numberLiteral) String() string {
+	return strconv.FormatFloat(float64(n), 'g', -1, 64)
+}
+
+type parenExpr struct {
+	expr Expr
+}
+
+func (p *parenExpr) eval(data map[string][]Sample) (value, error) {
+	return p.expr.eval(data)
+}
+
+func (p *parenExpr) String() string {
+	return "(" + p.expr.String() + ")"
+}
+
+type selectorExpr struct {
+	name     string
+	matchers []*Matcher
+}
+
+func (s *selectorExpr) eval(data map[string][]Sample) (value, error) {
+	var v []Sample
+next:
+	for _, sample := range data[s.name] {
+		for _, m := range s.matchers {
+			if !m.Matches(sample.Labels) {
+				continue next
+			}
+		}
+		v = append(v, sample)
+	}
+	return value{v: v}, nil
+}
+
+func (s *selectorExpr) String() string {
+	if len(s.matchers) == 0 {
+		return s.name
+	}
+	ms := make([]string, len(s.matchers))
+	for i, m := range s.matchers {
+		ms[i] = m.String()
+	}
+	return s.name + "{" + strings.Join(ms, ", ") + "}"
+}
+
+type aggregateExpr struct {
+	op      string
+	grouped bool
+	without bool
+	labels  []string
+	expr    Expr
+}
+
+func (a *aggregateExpr) eval(data map[string][]Sample) (value, error) {
+	in, err := a.expr.eval(data)
+	if err != nil {
+		return value{}, err
+	}
+	if in.scalar {
+		return value{}, fmt.Errorf("%s expects a vector", a.op)
+	}
+	type group struct {
+		labels map[string]string
+		value  float64
+		count  int
+	}
+	groups := map[string]*group{}
+	var keys []string
+	for _, s := range in.v {
+		labels := a.groupLabels(s.Labels)
+		key := signature(labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels, value: s.Value}
+			groups[key] = g
+			keys = append(keys, key)
+		} else {
+			switch a.op {
+			case "sum", "avg":
+				g.value += s.Value
+			case "max":
+				if s.Value > g.value || math.IsNaN(g.value) {
+					g.value = s.Value
+				}
+			case "min":
+				if s.Value < g.value || math.IsNaN(g.value) {
+					g.value = s.Value
+				}
+			}
+		}
+		g.count++
+	}
+	out := make([]Sample, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		switch a.op {
+		case "avg":
+			g.value /= float64(g.count)
+		case "count":
+			g.value = float64(g.count)
+		}
+		out = append(out, Sample{Labels: g.labels, Value: g.value})
+	}
+	return value{v: out}, nil
+}
+
+func (a *aggregateExpr) groupLabels(labels map[string]string) map[string]string {
+	out := map[string]string{}
+	if a.without {
+		for name, v := range labels {
+			out[name] = v
+		}
+		for _, name := range a.labels {
+			delete(out, name)
+		}
+		return out
+	}
+	for _, name := range a.labels {
+		if v, ok := labels[name]; ok {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+func (a *aggregateExpr) String() string {
+	s := a.op
+	if a.grouped {
+		grouping := "by"
+		if a.without {
+			grouping = "without"
+		}
+		s += " " + grouping + " (" + strings.Join(a.labels, ", ") + ")"
+	}
+	return s + " (" + a.expr.String() + ")"
+}
+
+type binaryExpr struct {
+	op       string
+	lhs, rhs Expr
+}
+
+func (b *binaryExpr) eval(data map[string][]Sample) (value, error) {
+	lhs, err := b.lhs.eval(data)
+	if err != nil {
+		return value{}, err
+	}
+	rhs, err := b.rhs.eval(data)
+	if err != nil {
+		return value{}, err
+	}
+	switch {
+	case lhs.scalar && rhs.scalar:
+		return value{scalar: true, s: arith(b.op, lhs.s, rhs.s)}, nil
+	case rhs.scalar:
+		out := make([]Sample, len(lhs.v))
+		for i, s := range lhs.v {
+			out[i] = Sample{Labels: s.Labels, Value: arith(b.op, s.Value, rhs.s)}
+		}
+		return value{v: out}, nil
+	case lhs.scalar:
+		out := make([]Sample, len(rhs.v))
+		for i, s := range rhs.v {
+			out[i] = Sample{Labels: s.Labels, Value: arith(b.op, lhs.s, s.Value)}
+		}
+		return value{v: out}, nil
+	}
+	// one-to-one matching of series with equal labels
+	rhsByKey := map[string]Sample{}
+	for _, s := range rhs.v {
+		key := signature(s.Labels)
+		if _, ok := rhsByKey[key]; ok {
+			return value{}, fmt.Errorf("duplicate series %v on the right side of %s", s.Labels, b.op)
+		}
+		rhsByKey[key] = s
+	}
+	seen := map[string]bool{}
+	var out []Sample
+	for _, s := range lhs.v {
+		key := signature(s.Labels)
+		r, ok := rhsByKey[key]
+		if !ok {
+			continue
+		}
+		if seen[key] {
+			return value{}, fmt.Errorf("duplicate series %v on the left side of %s", s.Labels, b.op)
+		}
+		seen[key] = true
+		out = append(out, Sample{Labels: s.Labels, Value: arith(b.op, s.Value, r.Value)})
+	}
+	return value{v: out}, nil
+}
+
+func (b *binaryExpr) String() string {
+	return b.lhs.String() + " " + b.op + " " + b.rhs.String()
+}
+
+func arith(op string, lhs, rhs float64) float64 {
+	switch op {
+	case "+":
+		return lhs + rhs
+	case "-":
+		return lhs - rhs
+	case "*":
+		return lhs * rhs
+	}
+	return lhs / rhs
+}
+
+// signature identifies a label set
+func signature(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte(0xfe)
+		sb.WriteString(labels[name])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
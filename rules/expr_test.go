@@ -0,0 +1,101 @@
+package rules
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+var testData = map[string][]Sample{
+	"asaka_api_call_count": {
+		{map[string]string{"session": "0", "client_id": "1", "api": "cuInit"}, 2},
+		{map[string]string{"session": "0", "client_id": "2", "api": "cuInit"}, 3},
+		{map[string]string{"session": "0", "client_id": "1", "api": "cuMemcpy"}, 10},
+	},
+	"asaka_api_running_time": {
+		{map[string]string{"session": "0", "client_id": "1", "api": "cuInit"}, 20},
+		{map[string]string{"session": "0", "client_id": "2", "api": "cuInit"}, 60},
+		{map[string]string{"session": "0", "client_id": "1", "api": "cuMemcpy"}, 5},
+	},
+}
+
+func TestEval(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected map[string]float64
+	}{
+		{"sum(asaka_api_call_count) by (api)", map[string]float64{"api=cuInit": 5, "api=cuMemcpy": 10}},
+		{"sum by (api) (asaka_api_call_count)", map[string]float64{"api=cuInit": 5, "api=cuMemcpy": 10}},
+		{"sum(asaka_api_call_count)", map[string]float64{"": 15}},
+		{"avg(asaka_api_call_count) by (api)", map[string]float64{"api=cuInit": 2.5, "api=cuMemcpy": 10}},
+		{"max(asaka_api_call_count) by (api)", map[string]float64{"api=cuInit": 3, "api=cuMemcpy": 10}},
+		{"min(asaka_api_call_count) by (api)", map[string]float64{"api=cuInit": 2, "api=cuMemcpy": 10}},
+		{"count(asaka_api_call_count) without (client_id, session)", map[string]float64{"api=cuInit": 2, "api=cuMemcpy": 1}},
+		{`sum(asaka_api_call_count{api=~"cu.*", client_id!="2"}) by (api)`, map[string]float64{"api=cuInit": 2, "api=cuMemcpy": 10}},
+		{`asaka_api_call_count{api="cuMemcpy"} * 2`, map[string]float64{"api=cuMemcpy,client_id=1,session=0": 20}},
+		{"sum(asaka_api_running_time) by (api) / sum(asaka_api_call_count) by (api)", map[string]float64{"api=cuInit": 16, "api=cuMemcpy": 0.5}},
+		{"(1 + 2) * 3 - -1", map[string]float64{"": 10}},
+		{"1 / sum(asaka_api_call_count{api!~\"cu.*\"})", map[string]float64{}},
+		{"missing_metric + 1", map[string]float64{}},
+	}
+	for idx, c := range cases {
+		e, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error: %v", idx+1, err)
+			continue
+		}
+		v, err := Eval(e, testData)
+		if err != nil {
+			t.Errorf("Case #%d, unexpected error: %v", idx+1, err)
+			continue
+		}
+		actual := map[string]float64{}
+		for _, s := range v {
+			actual[labelString(s.Labels)] = s.Value
+		}
+		if len(actual) != len(c.expected) {
+			t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, actual, c.expected)
+			continue
+		}
+		for k, ev := range c.expected {
+			if av, ok := actual[k]; !ok || math.Abs(av-ev) > 1e-9 {
+				t.Errorf("Case #%d, actual: %v, expected: %v", idx+1, actual, c.expected)
+			}
+		}
+	}
+}
+
+func TestParseExprInvalid(t *testing.T) {
+	cases := []string{
+		"",
+		"sum(",
+		"sum(x) by api",
+		`x{api="a"`,
+		`x{api=a}`,
+		`x{api=~"("}`,
+		"x ~ y",
+		"x y",
+		`x{api="a}`,
+	}
+	for idx, c := range cases {
+		if _, err := ParseExpr(c); err == nil {
+			t.Errorf("Case #%d, actual: nil, expected: error for %q", idx+1, c)
+		}
+	}
+}
+
+func labelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := ""
+	for i, name := range names {
+		if i > 0 {
+			s += ","
+		}
+		s += name + "=" + labels[name]
+	}
+	return s
+}
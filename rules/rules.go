@@ -0,0 +1,293 @@
+/*
+Package rules evaluates recording rules in the shape of Prometheus rule
+files over the metrics of a gatherer:
+
+	groups:
+	  - name: asaka_byapi
+	    rules:
+	    - record: asaka_api_call_count_sum
+	      expr: sum(asaka_api_call_count) by (api)
+
+Rules are evaluated in order, a rule can use the records of rules before it.
+*/
+package rules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+// Group is a named list of rules
+type Group struct {
+	Name  string
+	Rules []*Rule
+}
+
+// Rule records the result of Expr as metric Record with extra Labels
+type Rule struct {
+	Record string
+	Expr   Expr
+	Labels map[string]string
+}
+
+type ruleFile struct {
+	Groups []struct {
+		Name  string `yaml:"name"`
+		Rules []struct {
+			Record string            `yaml:"record"`
+			Expr   string            `yaml:"expr"`
+			Labels map[string]string `yaml:"labels"`
+		} `yaml:"rules"`
+	} `yaml:"groups"`
+}
+
+// Parse parses the groups of a rule file
+func Parse(content []byte) ([]*Group, error) {
+	var f ruleFile
+	if err := yaml.Unmarshal(content, &f); err != nil {
+		return nil, err
+	}
+	records := map[string]bool{}
+	var groups []*Group
+	for _, g := range f.Groups {
+		group := &Group{Name: g.Name}
+		for i, r := range g.Rules {
+			if len(r.Record) == 0 {
+				return nil, fmt.Errorf("group %s rule %d: record is missing", g.Name, i+1)
+			}
+			if records[r.Record] {
+				return nil, fmt.Errorf("group %s rule %s: recorded by another rule", g.Name, r.Record)
+			}
+			records[r.Record] = true
+			expr, err := ParseExpr(r.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("group %s rule %s: %v", g.Name, r.Record, err)
+			}
+			group.Rules = append(group.Rules, &Rule{Record: r.Record, Expr: expr, Labels: r.Labels})
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// Load reads and parses rule files
+func Load(paths ...string) ([]*Group, error) {
+	var groups []*Group
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		gs, err := Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		groups = append(groups, gs...)
+	}
+	return groups, nil
+}
+
+// Samples converts gathered metric families to samples by metric name,
+// histograms and summaries are converted to their _sum and _count series
+func Samples(mfs []*dto.MetricFamily) map[string][]Sample {
+	data := map[string][]Sample{}
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, lp := range m.Label {
+				if len(lp.GetValue()) > 0 {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				data[name] = append(data[name], Sample{labels, m.GetCounter().GetValue()})
+			case dto.MetricType_GAUGE:
+				data[name] = append(data[name], Sample{labels, m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				data[name] = append(data[name], Sample{labels, m.GetUntyped().GetValue()})
+			case dto.MetricType_SUMMARY:
+				data[name+"_sum"] = append(data[name+"_sum"], Sample{labels, m.GetSummary().GetSampleSum()})
+				data[name+"_count"] = append(data[name+"_count"], Sample{labels, float64(m.GetSummary().GetSampleCount())})
+			case dto.MetricType_HISTOGRAM:
+				data[name+"_sum"] = append(data[name+"_sum"], Sample{labels, m.GetHistogram().GetSampleSum()})
+				data[name+"_count"] = append(data[name+"_count"], Sample{labels, float64(m.GetHistogram().GetSampleCount())})
+			}
+		}
+	}
+	return data
+}
+
+// Evaluator evaluates rules over the metrics of a gatherer and exposes the
+// last results as collector
+type Evaluator struct {
+	groups   []*Group
+	gatherer prometheus.Gatherer
+
+	mu      sync.Mutex
+	results map[string][]Sample
+
+	evalErrors *prometheus.CounterVec
+	quitCh     chan struct{}
+	doneCh     chan struct{}
+}
+
+// NewEvaluator creates an evaluator of groups over g
+func NewEvaluator(groups []*Group, g prometheus.Gatherer) *Evaluator {
+	return &Evaluator{
+		groups:   groups,
+		gatherer: g,
+		results:  map[string][]Sample{},
+		evalErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hana_rule_evaluation_failures_total",
+				Help: "failed evaluations of recording rules",
+			},
+			[]string{"record"},
+		),
+	}
+}
+
+// Eval evaluates all rules once, failed rules keep no result
+func (e *Evaluator) Eval() error {
+	mfs, err := e.gatherer.Gather()
+	if err != nil && len(mfs) == 0 {
+		return err
+	}
+	data := Samples(mfs)
+	results := map[string][]Sample{}
+	var errs []error
+	for _, g := range e.groups {
+		for _, r := range g.Rules {
+			v, err := Eval(r.Expr, data)
+			if err != nil {
+				e.evalErrors.WithLabelValues(r.Record).Inc()
+				errs = append(errs, fmt.Errorf("rule %s: %v", r.Record, err))
+				continue
+			}
+			v = withLabels(v, r.Labels)
+			data[r.Record] = v
+			results[r.Record] = v
+		}
+	}
+	e.mu.Lock()
+	e.results = results
+	e.mu.Unlock()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func withLabels(v []Sample, labels map[string]string) []Sample {
+	if len(labels) == 0 {
+		return v
+	}
+	out := make([]Sample, len(v))
+	for i, s := range v {
+		ls := make(map[string]string, len(s.Labels)+len(labels))
+		for name, value := range s.Labels {
+			ls[name] = value
+		}
+		for name, value := range labels {
+			ls[name] = value
+		}
+		out[i] = Sample{Labels: ls, Value: s.Value}
+	}
+	return out
+}
+
+// Start evaluates the rules every interval until Stop is called
+func (e *Evaluator) Start(interval time.Duration) {
+	e.quitCh = make(chan struct{})
+	e.doneCh = make(chan struct{})
+	go func() {
+		defer close(e.doneCh)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.quitCh:
+				return
+			case <-ticker.C:
+				if err := e.Eval(); err != nil {
+					log.Println("failed to evaluate rules,", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the evaluation started by Start
+func (e *Evaluator) Stop() {
+	if e.quitCh == nil {
+		return
+	}
+	close(e.quitCh)
+	<-e.doneCh
+	e.quitCh = nil
+}
+
+func (e *Evaluator) help(record string) string {
+	for _, g := range e.groups {
+		for _, r := range g.Rules {
+			if r.Record == record {
+				return "recording rule " + r.Expr.String()
+			}
+		}
+	}
+	return record
+}
+
+func (e *Evaluator) Describe(ch chan<- *prometheus.Desc) {
+	for _, g := range e.groups {
+		for _, r := range g.Rules {
+			ch <- prometheus.NewDesc(r.Record, "recording rule "+r.Expr.String(), nil, nil)
+		}
+	}
+	e.evalErrors.Describe(ch)
+}
+
+// Collect exposes the results as untyped metrics, series of a record are
+// given the union of the label names of all its series
+func (e *Evaluator) Collect(ch chan<- prometheus.Metric) {
+	e.mu.Lock()
+	results := e.results
+	e.mu.Unlock()
+	for record, v := range results {
+		names := map[string]bool{}
+		for _, s := range v {
+			for name := range s.Labels {
+				names[name] = true
+			}
+		}
+		labelNames := make([]string, 0, len(names))
+		for name := range names {
+			labelNames = append(labelNames, name)
+		}
+		sort.Strings(labelNames)
+		desc := prometheus.NewDesc(record, e.help(record), labelNames, nil)
+		for _, s := range v {
+			lvs := make([]string, len(labelNames))
+			for i, name := range labelNames {
+				lvs[i] = s.Labels[name]
+			}
+			m, err := prometheus.NewConstMetric(desc, prometheus.UntypedValue, s.Value, lvs...)
+			if err != nil {
+				log.Println("failed to expose rule result,", err)
+				continue
+			}
+			ch <- m
+		}
+	}
+	e.evalErrors.Collect(ch)
+}
@@ -0,0 +1,66 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEvaluator(t *testing.T) {
+	groups, err := Load("../tools/asaka.rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	calls := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "asaka_api_call_count", Help: "calls"}, []string{"client_id", "api"})
+	calls.WithLabelValues("1", "cuInit").Set(2)
+	calls.WithLabelValues("2", "cuInit").Set(3)
+	reg.MustRegister(calls)
+
+	extra, err := Parse([]byte("groups:\n- name: derived\n  rules:\n  - record: asaka_api_call_count_doubled\n" +
+		"    expr: asaka_api_call_count_sum * 2\n    labels:\n      source: hana\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEvaluator(append(groups, extra...), reg)
+	reg.MustRegister(e)
+	if err := e.Eval(); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := Samples(mfs)
+	cases := []struct {
+		record   string
+		labels   string
+		expected float64
+	}{
+		{"asaka_api_call_count_sum", "api=cuInit", 5},
+		{"asaka_api_call_count_doubled", "api=cuInit,source=hana", 10},
+	}
+	for idx, c := range cases {
+		v := data[c.record]
+		if len(v) != 1 || labelString(v[0].Labels) != c.labels || v[0].Value != c.expected {
+			t.Errorf("Case #%d, actual: %v, expected: %s %v", idx+1, v, c.labels, c.expected)
+		}
+	}
+	if v := data["asaka_api_total_size_sum"]; len(v) != 0 {
+		t.Errorf("actual: %v, expected no series", v)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := []string{
+		"groups:\n- name: g\n  rules:\n  - expr: x\n",
+		"groups:\n- name: g\n  rules:\n  - record: a\n    expr: sum(\n",
+		"groups:\n- name: g\n  rules:\n  - record: a\n    expr: x\n  - record: a\n    expr: y\n",
+	}
+	for idx, c := range cases {
+		if _, err := Parse([]byte(c)); err == nil {
+			t.Errorf("Case #%d, actual: nil, expected: error", idx+1)
+		}
+	}
+}